@@ -0,0 +1,171 @@
+package k3sflux
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+const (
+	// defaultAgentJoinTimeout bounds the wait for the agents to join when
+	// Config.AgentJoinTimeout is zero.
+	defaultAgentJoinTimeout = 2 * time.Minute
+	// agentLogsDir is where the agents write their logs, on a cache volume
+	// shared with the tools container.
+	agentLogsDir = "/cache/agent-logs"
+	// agentLogLines is how much of an agent log is reported when it failed
+	// to join.
+	agentLogLines = 20
+)
+
+// node is the subset of a Node object the helpers read back from the
+// cluster.
+type node struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Status struct {
+		Conditions []condition `json:"conditions"`
+	} `json:"status"`
+}
+
+func (n node) ready() bool {
+	return findReady(n.Status.Conditions).Status == "True"
+}
+
+// agentName is the node name of the i-th agent.
+func agentName(i int) string {
+	return fmt.Sprintf("agent-%d", i)
+}
+
+// agentAlias is the hostname the i-th agent service is bound to.
+func (k *K8sInstance) agentAlias(i int) string {
+	return k.serviceAlias() + "-" + agentName(i)
+}
+
+func (k *K8sInstance) agentLogs() *dagger.CacheVolume {
+	return k.client.CacheVolume(cacheName(agentLogsCacheKey, k.cfg.Name))
+}
+
+// joinToken returns the secret the agents authenticate to the server with,
+// generated once per instance.
+func (k *K8sInstance) joinToken() (*dagger.Secret, error) {
+	if err := k.requireSession("joinToken"); err != nil {
+		return nil, err
+	}
+	if k.agentToken == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate the k3s join token: %w", err)
+		}
+		k.agentToken = hex.EncodeToString(b)
+	}
+	return k.client.SetSecret("k3s-token", k.agentToken), nil
+}
+
+// withJoinToken sets the token the server and agents share, when there are
+// agents to join.
+func withJoinToken(token *dagger.Secret) dagger.WithContainerFunc {
+	return func(c *dagger.Container) *dagger.Container {
+		if token == nil {
+			return c
+		}
+		return c.WithSecretVariable("K3S_TOKEN", token)
+	}
+}
+
+// agent is the service container of the i-th agent, joining server.
+func (k *K8sInstance) agent(i int, server *dagger.Container, token *dagger.Secret) *dagger.Container {
+	command := fmt.Sprintf(
+		"k3s agent --server https://%s:6443 --node-name %s --log %s/%s.log",
+		k.serviceAlias(), agentName(i), agentLogsDir, agentName(i),
+	)
+	return k.from(k.k3sImage()).Pipeline("k3s "+agentName(i)).
+		With(k.registriesFile).
+		WithServiceBinding(k.serviceAlias(), server).
+		With(withJoinToken(token)).
+		WithMountedCache(agentLogsDir, k.agentLogs()).
+		WithMountedTemp("/etc/lib/cni").
+		WithMountedTemp("/var/lib/kubelet").
+		WithMountedTemp(k3sDataDir).
+		WithMountedTemp("/var/log").
+		WithEnvVariable("CACHE", time.Now().String()).
+		WithEntrypoint([]string{"sh", "-c"}).
+		WithExec([]string{command}, dagger.ContainerWithExecOpts{InsecureRootCapabilities: true})
+}
+
+// withAgents binds the Config.Agents agent services to the tools container,
+// which starts them along with the server.
+func (k *K8sInstance) withAgents(server *dagger.Container, token *dagger.Secret) dagger.WithContainerFunc {
+	return func(c *dagger.Container) *dagger.Container {
+		if k.cfg.Agents == 0 {
+			return c
+		}
+		c = c.WithMountedCache(agentLogsDir, k.agentLogs())
+		for i := 0; i < k.cfg.Agents; i++ {
+			c = c.WithServiceBinding(k.agentAlias(i), k.agent(i, server, token))
+		}
+		return c
+	}
+}
+
+// waitForAgents waits for every agent to be a Ready node. Agents missing at
+// the deadline are reported with the tail of their logs, failing the start
+// or only warning as Config.OnAgentJoinFailure says.
+func (k *K8sInstance) waitForAgents() error {
+	if k.cfg.Agents == 0 {
+		return nil
+	}
+	timeout := k.cfg.AgentJoinTimeout
+	if timeout == 0 {
+		timeout = defaultAgentJoinTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	var missing []string
+	for {
+		var list struct {
+			Items []node `json:"items"`
+		}
+		if err := k.kubectlJSON("get nodes", &list); err != nil {
+			return fmt.Errorf("failed to list nodes: %w", err)
+		}
+		ready := map[string]bool{}
+		for _, n := range list.Items {
+			ready[n.Metadata.Name] = n.ready()
+		}
+		missing = missing[:0]
+		for i := 0; i < k.cfg.Agents; i++ {
+			if !ready[agentName(i)] {
+				missing = append(missing, agentName(i))
+			}
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		if time.Now().Add(podPollInterval).After(deadline) {
+			break
+		}
+		time.Sleep(podPollInterval)
+	}
+
+	var report strings.Builder
+	fmt.Fprintf(&report, "%d of %d agent(s) did not join within %v: %s", len(missing), k.cfg.Agents, timeout, strings.Join(missing, ", "))
+	for _, name := range missing {
+		res, err := k.exec("k3s "+name, fmt.Sprintf("tail -n %d %s/%s.log", agentLogLines, agentLogsDir, name), true)
+		if err != nil {
+			fmt.Fprintf(&report, "\n%s: no logs (%v)", name, err)
+			continue
+		}
+		fmt.Fprintf(&report, "\n%s logs:\n%s", name, strings.TrimRight(res.Stdout, "\n"))
+	}
+	if k.cfg.OnAgentJoinFailure == AgentJoinProceed {
+		k.warnf("continuing with %d node(s): %s", 1+k.cfg.Agents-len(missing), report.String())
+		return nil
+	}
+	return errors.New(report.String())
+}
@@ -0,0 +1,70 @@
+package k3sflux
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitForAgents(t *testing.T) {
+	nodes := func(ready ...string) ExecResult {
+		var items []string
+		for _, name := range ready {
+			items = append(items, `{"metadata": {"name": "`+name+`"}, "status": {"conditions": [{"type": "Ready", "status": "True"}]}}`)
+		}
+		return ExecResult{Stdout: `{"items": [` + strings.Join(items, ",") + `]}`}
+	}
+	tests := []struct {
+		name     string
+		cfg      Config
+		nodes    ExecResult
+		logs     ExecResult
+		wantErr  []string
+		warnings int
+	}{
+		{name: "no agents", nodes: ExecResult{ExitCode: 1}},
+		{name: "joined", cfg: Config{Agents: 2}, nodes: nodes("server", "agent-0", "agent-1")},
+		{
+			name:    "timeout fails the start",
+			cfg:     Config{Agents: 2, AgentJoinTimeout: time.Nanosecond, OnAgentJoinFailure: AgentJoinFail},
+			nodes:   nodes("server", "agent-0"),
+			logs:    ExecResult{Stdout: "level=error msg=\"failed to get CA certs\"\n"},
+			wantErr: []string{"1 of 2 agent(s) did not join", "agent-1 logs:\nlevel=error msg=\"failed to get CA certs\""},
+		},
+		{
+			name:    "timeout without logs",
+			cfg:     Config{Agents: 1, AgentJoinTimeout: time.Nanosecond},
+			nodes:   nodes("server"),
+			logs:    ExecResult{Stderr: "tail: can't open", ExitCode: 1},
+			wantErr: []string{"1 of 1 agent(s) did not join", "agent-0: no logs"},
+		},
+		{
+			name:     "timeout proceeds",
+			cfg:      Config{Agents: 2, AgentJoinTimeout: time.Nanosecond, OnAgentJoinFailure: AgentJoinProceed},
+			nodes:    nodes("server", "agent-0"),
+			warnings: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := script(step("kubectl get nodes -o json", tt.nodes), step("tail -n 20 /cache/agent-logs/", tt.logs))
+			k := NewOfflineInstance(context.Background(), tt.cfg, e)
+			err := k.waitForAgents()
+			if len(tt.wantErr) == 0 && err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("waitForAgents() error = %v, want %q", err, want)
+				}
+			}
+			if len(k.warnings) != tt.warnings {
+				t.Errorf("warnings = %q, want %d", k.warnings, tt.warnings)
+			}
+			if tt.cfg.Agents == 0 && len(e.commands) > 0 {
+				t.Errorf("ran %q without agents", e.commands)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package k3sflux
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// manifestsDir is where manifests handed over as files are mounted.
+const manifestsDir = "/manifests"
+
+// Apply runs kubectl apply on a single manifest file.
+func (k *K8sInstance) Apply(file *dagger.File) (string, error) {
+	if err := k.requireSession("Apply"); err != nil {
+		return "", err
+	}
+	p := path.Join(manifestsDir, "apply.yaml")
+	return stdout(k.execIn(k.container.WithMountedFile(p, file), "apply", fmt.Sprintf("kubectl apply -f %s", p), true))
+}
+
+// verifyLogLines is how much of the logs of a failed workload ApplyAndVerify
+// reports.
+const verifyLogLines = 20
+
+// ApplyAndVerify applies a manifest, which may hold several objects, and
+// waits for them to be ready: rollouts of Deployments, StatefulSets and
+// DaemonSets to complete, Pods to be ready and Jobs to complete. Other
+// objects count as ready once applied. When an object does not get there
+// within timeout, everything in the manifest is deleted again and the
+// failure returned with the tail of the object's logs, leaving no broken
+// resources behind.
+func (k *K8sInstance) ApplyAndVerify(file *dagger.File, timeout time.Duration) error {
+	if err := k.requireSession("ApplyAndVerify"); err != nil {
+		return err
+	}
+	p := path.Join(manifestsDir, "verify.yaml")
+	c := k.container.WithMountedFile(p, file)
+	res, err := k.execIn(c, "apply", fmt.Sprintf("kubectl apply -f %s -o json", p), true)
+	if err != nil {
+		return k.rollback(c, p, fmt.Errorf("failed to apply manifest: %w", err))
+	}
+	// a manifest with several objects comes back as a List
+	var applied struct {
+		object
+		Items []object `json:"items"`
+	}
+	if err := json.Unmarshal([]byte(res.Stdout), &applied); err != nil {
+		return k.rollback(c, p, fmt.Errorf("failed to decode applied objects: %w", err))
+	}
+	objects := applied.Items
+	if applied.Kind != "List" {
+		objects = []object{applied.object}
+	}
+	deadline := time.Now().Add(timeout)
+	for _, o := range objects {
+		var command string
+		switch o.Kind {
+		case "Deployment", "StatefulSet", "DaemonSet":
+			command = fmt.Sprintf("rollout status %s/%s", strings.ToLower(o.Kind), o.Metadata.Name)
+		case "Pod":
+			command = fmt.Sprintf("wait pod/%s --for=condition=ready", o.Metadata.Name)
+		case "Job":
+			command = fmt.Sprintf("wait job/%s --for=condition=complete", o.Metadata.Name)
+		default:
+			continue
+		}
+		if o.Metadata.Namespace != "" {
+			command += " -n " + o.Metadata.Namespace
+		}
+		remaining := time.Until(deadline).Round(time.Second)
+		if remaining <= 0 {
+			return k.rollback(c, p, fmt.Errorf("%s/%s was not checked before the %v timeout", o.Kind, o.Metadata.Name, timeout))
+		}
+		if _, err := k.kubectlDeadline(c, command, remaining); err != nil {
+			return k.rollback(c, p, fmt.Errorf("%s/%s did not become ready: %w%s", o.Kind, o.Metadata.Name, err, k.workloadLogs(o)))
+		}
+	}
+	return nil
+}
+
+// workloadLogs returns the tail of the logs of o for an error message, or
+// nothing when kubectl has none to show.
+func (k *K8sInstance) workloadLogs(o object) string {
+	command := fmt.Sprintf("logs %s/%s --all-containers --tail=%d", strings.ToLower(o.Kind), o.Metadata.Name, verifyLogLines)
+	if o.Metadata.Namespace != "" {
+		command += " -n " + o.Metadata.Namespace
+	}
+	res, err := k.kubectl(command, true)
+	if err != nil || strings.TrimSpace(res.Stdout) == "" {
+		return ""
+	}
+	return "\nlogs:\n" + strings.TrimRight(res.Stdout, "\n")
+}
+
+// rollback deletes the objects of the manifest mounted at p in c after cause
+// made ApplyAndVerify fail, returning cause joined with any failure to
+// delete them.
+func (k *K8sInstance) rollback(c *dagger.Container, p string, cause error) error {
+	if _, err := k.execIn(c, "rollback", fmt.Sprintf("kubectl delete -f %s --ignore-not-found", p), true); err != nil {
+		return errors.Join(cause, fmt.Errorf("failed to roll back manifest: %w", err))
+	}
+	return cause
+}
+
+// ApplyPhase is a set of manifests that do not depend on each other and are
+// applied in parallel.
+type ApplyPhase struct {
+	Name      string
+	Manifests []*dagger.File
+	// WaitFor is the kubectl wait --for condition the applied objects must
+	// reach before the next phase starts, e.g. condition=established for
+	// CRDs. Empty moves on right after applying.
+	WaitFor string
+	// Timeout bounds the WaitFor wait, defaulting to five minutes.
+	Timeout time.Duration
+}
+
+// ApplyPhases applies the phases in order, waiting for each one to be ready
+// before starting the next. It stops at the first phase that fails.
+func (k *K8sInstance) ApplyPhases(phases []ApplyPhase) error {
+	if err := k.requireSession("ApplyPhases"); err != nil {
+		return err
+	}
+	for _, phase := range phases {
+		if err := k.applyPhase(phase); err != nil {
+			return fmt.Errorf("phase %s: %w", phase.Name, err)
+		}
+	}
+	return nil
+}
+
+func (k *K8sInstance) applyPhase(phase ApplyPhase) error {
+	timeout := phase.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+	errs := make([]error, len(phase.Manifests))
+	var wg sync.WaitGroup
+	for i, file := range phase.Manifests {
+		wg.Add(1)
+		go func(i int, file *dagger.File) {
+			defer wg.Done()
+			p := path.Join(manifestsDir, phase.Name, fmt.Sprintf("%d.yaml", i))
+			c := k.container.WithMountedFile(p, file)
+			if _, err := k.execIn(c, "apply "+phase.Name, fmt.Sprintf("kubectl apply -f %s", p), true); err != nil {
+				errs[i] = fmt.Errorf("failed to apply manifest %d: %w", i, err)
+				return
+			}
+			if phase.WaitFor == "" {
+				return
+			}
+			if _, err := k.kubectlWait(c, fmt.Sprintf("-f %s --for=%s", p, phase.WaitFor), timeout); err != nil {
+				errs[i] = fmt.Errorf("manifest %d did not reach %s: %w", i, phase.WaitFor, err)
+			}
+		}(i, file)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServerDryRunApply renders the kustomization at p, relative to the cloned
+// repository, and applies it with --dry-run=server. Unlike flux diff this
+// goes through admission, so policy webhooks (Kyverno, Gatekeeper) get to
+// reject objects. The apply output is returned together with an error
+// aggregating every rejection.
+func (k *K8sInstance) ServerDryRunApply(p string) (string, error) {
+	dir := shellQuote(path.Join(srcDir, p))
+	rendered := shellQuote(path.Join(k.workDir(), "dry-run.yaml"))
+	res, err := k.kubectl(fmt.Sprintf("kustomize %s > %s && kubectl apply --dry-run=server -f %s 2>&1", dir, rendered, rendered), true)
+	out := res.Stdout
+	if err == nil {
+		return out, nil
+	}
+	if res.ExitCode == 0 || strings.TrimSpace(out) == "" {
+		return "", fmt.Errorf("failed to render %s: %w", p, err)
+	}
+	var rejections []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "Error from server") || strings.HasPrefix(line, "error:") {
+			rejections = append(rejections, line)
+		}
+	}
+	if len(rejections) == 0 {
+		return out, fmt.Errorf("server dry-run of %s failed: %w", p, err)
+	}
+	return out, fmt.Errorf("server dry-run of %s rejected %d object(s):\n%s", p, len(rejections), strings.Join(rejections, "\n"))
+}
@@ -0,0 +1,229 @@
+package k3sflux
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// bootstrap runs flux bootstrap against the configured repository path,
+// retrying recoverable failures Config.BootstrapRetries times. Before each
+// retry the prerequisites are checked and the flux controllers left by the
+// failed attempt are waited for; when every attempt failed, the error
+// carries the last flux check output.
+func (k *K8sInstance) bootstrap() error {
+	backoff := k.cfg.BootstrapRetryBackoff
+	if backoff == 0 {
+		backoff = defaultBootstrapRetryBackoff
+	}
+	var check string
+	for attempt := 0; ; attempt++ {
+		err := k.bootstrapOnce()
+		if err == nil || !recoverableBootstrapError(err) {
+			return err
+		}
+		if attempt >= k.cfg.BootstrapRetries {
+			if check == "" {
+				return err
+			}
+			return fmt.Errorf("flux bootstrap failed %d time(s): %w\nlast flux check --pre:\n%s", attempt+1, err, check)
+		}
+		// flux bootstrap is idempotent, but a failure past the commit may
+		// still have left a synced flux behind
+		if done, checkErr := k.IsBootstrapped(); checkErr == nil && done {
+			k.warnf("flux bootstrap failed but flux is synced, not retrying: %v", err)
+			return nil
+		}
+		k.warnf("flux bootstrap failed, retrying in %v (%d/%d): %v", backoff, attempt+1, k.cfg.BootstrapRetries, err)
+		select {
+		case <-k.ctx.Done():
+			return fmt.Errorf("gave up retrying flux bootstrap: %w", k.ctx.Err())
+		case <-time.After(backoff):
+		}
+		if check, err = k.checkBootstrapPrerequisites(); err != nil {
+			return err
+		}
+	}
+}
+
+// bootstrapOnce runs a single flux bootstrap.
+func (k *K8sInstance) bootstrapOnce() error {
+	if k.cfg.BootstrapAuth == BootstrapAuthToken && k.token() == "" {
+		return fmt.Errorf("flux bootstrap needs a GitHub token with repository access on %s, set GITHUB_TOKEN or GITHUB_TOKEN_FILE", k.cfg.Bootstrap.Hostname)
+	}
+	if err := k.checkBootstrapPath(k.cfg.Bootstrap.Path); err != nil {
+		return err
+	}
+	patched, err := k.checkFluxSystemKustomization(k.cfg.Bootstrap.Path)
+	if err != nil {
+		return err
+	}
+	kustomization, err := k.bootstrapKustomization(k.cfg)
+	if err != nil {
+		return err
+	}
+	if patched && kustomization != nil {
+		return fmt.Errorf("%s/%s already patches flux, add the BootstrapKustomization or FluxResourceProfile patches to it instead", k.cfg.Bootstrap.Path, fluxSystemKustomization)
+	}
+	c := k.container
+	if kustomization != nil {
+		c = c.WithMountedFile(bootstrapKustomizationPath, kustomization)
+	}
+	if _, err := k.execIn(c, "bootstrap", "flux "+k.bootstrapCommand(kustomization != nil), true); err != nil {
+		return err
+	}
+	if k.cfg.FluxResourceProfile != FluxResourceDefault {
+		return k.assertFluxScheduled()
+	}
+	return nil
+}
+
+// bootstrapKustomization returns the kustomization handed to flux bootstrap,
+// either cfg.BootstrapKustomization or the one of the resource profile.
+func (k *K8sInstance) bootstrapKustomization(cfg Config) (*dagger.File, error) {
+	profile, err := k.profileKustomization(cfg.FluxResourceProfile)
+	if err != nil {
+		return nil, err
+	}
+	if profile != nil && cfg.BootstrapKustomization != nil {
+		return nil, fmt.Errorf("BootstrapKustomization and FluxResourceProfile cannot be combined, add the profile patches to the kustomization instead")
+	}
+	if profile != nil {
+		return profile, nil
+	}
+	return cfg.BootstrapKustomization, nil
+}
+
+// bootstrapKustomizationPath is where Config.BootstrapKustomization is
+// mounted for flux bootstrap.
+const bootstrapKustomizationPath = "/bootstrap/kustomization.yaml"
+
+// bootstrapCommand assembles the flux bootstrap arguments from the config.
+func (k *K8sInstance) bootstrapCommand(withKustomization bool) string {
+	b := k.cfg.Bootstrap
+	var command string
+	if k.cfg.BootstrapAuth == BootstrapAuthSSH {
+		// --silent skips the prompt asking to add the key to the repository
+		command = fmt.Sprintf("bootstrap git --url=%s --branch=%s --path=%s --private-key-file=%s --silent", b.sshURL(), b.Branch, b.Path, sshKeyPath)
+	} else {
+		command = fmt.Sprintf("bootstrap github --owner=%s --repository=%s --branch=%s --path=%s", b.Owner, b.Repository, b.Branch, b.Path)
+		if b.Hostname != defaultGitHubHost {
+			command += fmt.Sprintf(" --hostname=%s --ssh-hostname=%s", b.Hostname, b.Hostname)
+		}
+	}
+	if len(k.cfg.ComponentsExtra) > 0 {
+		command += fmt.Sprintf(" --components-extra=%s", strings.Join(k.cfg.ComponentsExtra, ","))
+	}
+	if withKustomization {
+		command += " --kustomization=" + bootstrapKustomizationPath
+	}
+	if k.cfg.BootstrapTimeout > 0 {
+		command += fmt.Sprintf(" --timeout=%s", k.cfg.BootstrapTimeout)
+	}
+	return command
+}
+
+// fluxSystemKustomization is the kustomization flux bootstrap writes in the
+// cluster path, which repositories patch to customize the flux components.
+const fluxSystemKustomization = "flux-system/kustomization.yaml"
+
+// checkFluxSystemKustomization validates the flux-system kustomization of the
+// cluster path p, reporting whether the repository patches it. flux bootstrap
+// keeps an existing kustomization, including its patches, and only rewrites
+// gotk-components.yaml and gotk-sync.yaml, so it has to list both and render.
+// A path without flux-system is bootstrapped from scratch.
+func (k *K8sInstance) checkFluxSystemKustomization(p string) (bool, error) {
+	dir := shellQuote(path.Join(srcDir, p, "flux-system"))
+	command := fmt.Sprintf(
+		"if [ ! -d %[1]s ]; then echo missing; elif [ ! -f %[1]s/kustomization.yaml ]; then echo incomplete; "+
+			"elif ! grep -q gotk-components.yaml %[1]s/kustomization.yaml || ! grep -q gotk-sync.yaml %[1]s/kustomization.yaml; then echo foreign; "+
+			"elif kubectl kustomize %[1]s > /dev/null; then grep -qE '^(patches|patchesStrategicMerge|patchesJson6902):' %[1]s/kustomization.yaml && echo patched || echo valid; else exit 1; fi",
+		dir,
+	)
+	res, err := k.exec("check flux-system", command, false)
+	if err != nil {
+		return false, fmt.Errorf("%s/%s does not render: %w", p, fluxSystemKustomization, err)
+	}
+	switch strings.TrimSpace(res.Stdout) {
+	case "missing":
+		return false, nil
+	case "incomplete":
+		return false, fmt.Errorf("%s/flux-system has no kustomization.yaml", p)
+	case "foreign":
+		return false, fmt.Errorf("%s/%s does not list gotk-components.yaml and gotk-sync.yaml", p, fluxSystemKustomization)
+	}
+	return strings.TrimSpace(res.Stdout) == "patched", nil
+}
+
+// checkBootstrapPath makes sure p exists in the cloned repository. Flux
+// creates a missing path on bootstrap, so a typo silently ends up as an empty
+// cluster; this warns about it, or fails when Config.StrictPaths is set.
+func (k *K8sInstance) checkBootstrapPath(p string) error {
+	res, err := k.exec("check path", fmt.Sprintf("test -d %s && echo found || echo missing", shellQuote(path.Join(srcDir, p))), false)
+	if err != nil {
+		return fmt.Errorf("failed to check bootstrap path %s: %v", p, err)
+	}
+	if strings.TrimSpace(res.Stdout) == "found" {
+		return nil
+	}
+	if k.cfg.StrictPaths {
+		return fmt.Errorf("bootstrap path %s does not exist in the repository", p)
+	}
+	k.warnf("bootstrap path %s does not exist in the repository, flux will create it", p)
+	return nil
+}
+
+// RenderBootstrapManifests renders what flux bootstrap commits to the
+// repository, the gotk components and the flux-system sync objects, without
+// touching git or the cluster. cfg provides the same knobs bootstrap uses,
+// from the tool images to the kustomization of Config.BootstrapKustomization
+// or Config.FluxResourceProfile, which patches the rendered components like
+// flux-system/kustomization.yaml patches them in the cluster.
+func (k *K8sInstance) RenderBootstrapManifests(cfg Config) (string, error) {
+	if err := k.requireSession("RenderBootstrapManifests"); err != nil {
+		return "", err
+	}
+	kustomization, err := k.bootstrapKustomization(cfg)
+	if err != nil {
+		return "", err
+	}
+	b := cfg.Bootstrap.withDefaults()
+	install := "install --export"
+	if len(cfg.ComponentsExtra) > 0 {
+		install += fmt.Sprintf(" --components-extra=%s", strings.Join(cfg.ComponentsExtra, ","))
+	}
+	commands := []string{
+		install,
+		fmt.Sprintf("create source git flux-system --url=https://%s --branch=%s --interval=1m --export", b.repo(), b.Branch),
+		fmt.Sprintf("create kustomization flux-system --source=GitRepository/flux-system --path=./%s --prune=true --interval=10m --export", b.Path),
+	}
+	tools := k.toolsContainerFor(cfg).WithEntrypoint([]string{"sh", "-c"})
+	var docs []string
+	for _, command := range commands {
+		res, err := k.execIn(tools, "render bootstrap", "flux "+command, false)
+		if err != nil {
+			return "", fmt.Errorf("failed to render flux %s: %w", command, err)
+		}
+		docs = append(docs, strings.TrimSpace(res.Stdout))
+	}
+	if kustomization == nil {
+		return strings.Join(docs, "\n---\n") + "\n", nil
+	}
+	dir := path.Join(renderBootstrapDir, "flux-system")
+	c := tools.
+		WithNewFile(path.Join(dir, "gotk-components.yaml"), dagger.ContainerWithNewFileOpts{Contents: docs[0] + "\n"}).
+		WithNewFile(path.Join(dir, "gotk-sync.yaml"), dagger.ContainerWithNewFileOpts{Contents: strings.Join(docs[1:], "\n---\n") + "\n"}).
+		WithMountedFile(path.Join(dir, "kustomization.yaml"), kustomization)
+	res, err := k.execIn(c, "render bootstrap", "kubectl kustomize "+dir, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to apply the bootstrap kustomization: %w", err)
+	}
+	return res.Stdout, nil
+}
+
+// renderBootstrapDir is where RenderBootstrapManifests lays out flux-system
+// to apply the bootstrap kustomization.
+const renderBootstrapDir = "/render"
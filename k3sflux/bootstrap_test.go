@@ -0,0 +1,108 @@
+package k3sflux
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBootstrapCommand(t *testing.T) {
+	bootstrap := BootstrapConfig{Owner: "acme", Repository: "fleet", Branch: "main", Path: "clusters/ci"}
+	tests := []struct {
+		name              string
+		cfg               Config
+		withKustomization bool
+		want              string
+	}{
+		{
+			name: "token",
+			cfg:  Config{Bootstrap: bootstrap},
+			want: "bootstrap github --owner=acme --repository=fleet --branch=main --path=clusters/ci",
+		},
+		{
+			name: "github enterprise",
+			cfg:  Config{Bootstrap: BootstrapConfig{Hostname: "git.acme.internal", Owner: "acme", Repository: "fleet", Branch: "main", Path: "clusters/ci"}},
+			want: "bootstrap github --owner=acme --repository=fleet --branch=main --path=clusters/ci --hostname=git.acme.internal --ssh-hostname=git.acme.internal",
+		},
+		{
+			name: "ssh",
+			cfg:  Config{Bootstrap: bootstrap, BootstrapAuth: BootstrapAuthSSH},
+			want: "bootstrap git --url=ssh://git@github.com/acme/fleet.git --branch=main --path=clusters/ci --private-key-file=/ssh/identity --silent",
+		},
+		{
+			name:              "components, kustomization and timeout",
+			cfg:               Config{Bootstrap: bootstrap, ComponentsExtra: []string{"image-reflector-controller", "image-automation-controller"}, BootstrapTimeout: 10 * time.Minute},
+			withKustomization: true,
+			want:              "bootstrap github --owner=acme --repository=fleet --branch=main --path=clusters/ci --components-extra=image-reflector-controller,image-automation-controller --kustomization=/bootstrap/kustomization.yaml --timeout=10m0s",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := NewOfflineInstance(context.Background(), tt.cfg, RecordedExecutor{})
+			if got := k.bootstrapCommand(tt.withKustomization); got != tt.want {
+				t.Errorf("bootstrapCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckBootstrapPath(t *testing.T) {
+	lookup := "test -d '/src/clusters/ci' && echo found || echo missing"
+	tests := []struct {
+		name     string
+		found    string
+		strict   bool
+		wantErr  bool
+		warnings int
+	}{
+		{name: "found", found: "found\n"},
+		{name: "missing", found: "missing\n", warnings: 1},
+		{name: "missing with StrictPaths", found: "missing\n", strict: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := NewOfflineInstance(context.Background(), Config{StrictPaths: tt.strict}, RecordedExecutor{lookup: {Stdout: tt.found}})
+			if err := k.checkBootstrapPath("clusters/ci"); (err != nil) != tt.wantErr {
+				t.Fatalf("checkBootstrapPath() error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(k.warnings) != tt.warnings {
+				t.Errorf("warnings = %q, want %d", k.warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestCheckFluxSystemKustomization(t *testing.T) {
+	tests := []struct {
+		name    string
+		check   ExecResult
+		patched bool
+		wantErr string
+	}{
+		{name: "bootstrapped from scratch", check: ExecResult{Stdout: "missing\n"}},
+		{name: "valid", check: ExecResult{Stdout: "valid\n"}},
+		{name: "patched", check: ExecResult{Stdout: "patched\n"}, patched: true},
+		{name: "missing kustomization", check: ExecResult{Stdout: "incomplete\n"}, wantErr: "clusters/ci/flux-system has no kustomization.yaml"},
+		{name: "wrong resources", check: ExecResult{Stdout: "foreign\n"}, wantErr: "does not list gotk-components.yaml and gotk-sync.yaml"},
+		{name: "does not render", check: ExecResult{Stderr: "accumulating resources: missing.yaml", ExitCode: 1}, wantErr: "clusters/ci/flux-system/kustomization.yaml does not render"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := script(step("if [ ! -d '/src/clusters/ci/flux-system' ]", tt.check))
+			patched, err := NewOfflineInstance(context.Background(), Config{}, e).checkFluxSystemKustomization("clusters/ci")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("checkFluxSystemKustomization() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if patched != tt.patched {
+				t.Errorf("checkFluxSystemKustomization() = %v, want %v", patched, tt.patched)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package k3sflux
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultBootstrapRetryBackoff and defaultBootstrapRetryTimeout pace
+	// the bootstrap retries when Config.BootstrapRetryBackoff and
+	// Config.BootstrapRetryTimeout are zero.
+	defaultBootstrapRetryBackoff = 15 * time.Second
+	defaultBootstrapRetryTimeout = 2 * time.Minute
+)
+
+// recoverableBootstrapFailures are the lowercased fragments of flux
+// bootstrap output caused by GitHub or the network rather than the config.
+var recoverableBootstrapFailures = []string{
+	"rate limit",
+	"500 internal server error",
+	"502 bad gateway",
+	"503 service unavailable",
+	"504 gateway timeout",
+	"connection reset by peer",
+	"tls handshake timeout",
+	"i/o timeout",
+	"unexpected eof",
+	// the flux controllers or their webhooks not serving yet
+	"context deadline exceeded",
+	"timed out waiting for the condition",
+	"connection refused",
+	"no endpoints available",
+}
+
+// recoverableBootstrapError reports whether err is a flux bootstrap failure
+// worth retrying. Only a command that ran and exited non-zero qualifies;
+// errors such as a missing token or an invalid path never do.
+func recoverableBootstrapError(err error) bool {
+	res, ok := execFailure(err)
+	if !ok {
+		return false
+	}
+	output := strings.ToLower(res.Stdout + res.Stderr)
+	for _, failure := range recoverableBootstrapFailures {
+		if strings.Contains(output, failure) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBootstrapPrerequisites runs flux check --pre, returning its output,
+// and waits for the rollout of the flux controllers a failed bootstrap
+// installed. Failing prerequisites end the retries; controllers still not
+// rolled out are only warned about, as the next attempt installs them anew.
+func (k *K8sInstance) checkBootstrapPrerequisites() (string, error) {
+	res, err := k.flux("check --pre", true)
+	check := strings.TrimSpace(res.Stdout + "\n" + res.Stderr)
+	if err != nil {
+		return check, fmt.Errorf("flux prerequisites are not met:\n%s", check)
+	}
+	timeout := k.cfg.BootstrapRetryTimeout
+	if timeout == 0 {
+		timeout = defaultBootstrapRetryTimeout
+	}
+	deployments, err := k.kubectl("get deployments -n flux-system -o name", true)
+	if err != nil {
+		k.warnf("failed to list the flux controllers: %v", err)
+		return check, nil
+	}
+	for _, d := range strings.Fields(deployments.Stdout) {
+		if _, err := k.kubectlDeadline(k.container, "rollout status -n flux-system "+d, timeout); err != nil {
+			k.warnf("%s did not roll out before retrying bootstrap: %v", d, err)
+		}
+	}
+	return check, nil
+}
+
+// IsBootstrapped reports whether flux is installed and its flux-system
+// GitRepository is Ready, i.e. bootstrap got as far as syncing the
+// repository.
+func (k *K8sInstance) IsBootstrapped() (bool, error) {
+	installed, err := k.fluxInstalled()
+	if err != nil || !installed {
+		return false, err
+	}
+	var list struct {
+		Items []struct {
+			Status struct {
+				Conditions []condition `json:"conditions"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := k.kubectlJSON("get gitrepositories -n flux-system --field-selector metadata.name=flux-system", &list); err != nil {
+		return false, fmt.Errorf("failed to look up the flux-system GitRepository: %w", err)
+	}
+	if len(list.Items) == 0 {
+		return false, nil
+	}
+	return findReady(list.Items[0].Status.Conditions).Status == "True", nil
+}
@@ -0,0 +1,107 @@
+package k3sflux
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBootstrapRetries(t *testing.T) {
+	unavailable := ExecResult{Stderr: "✗ GET https://api.github.com/repos/acme/fleet: 503 Service Unavailable", ExitCode: 1}
+	tests := []struct {
+		name      string
+		retries   int
+		bootstrap []ExecResult
+		synced    bool
+		attempts  int
+		wantErr   string
+	}{
+		{
+			name:      "recoverable failure retried",
+			retries:   2,
+			bootstrap: []ExecResult{unavailable, {Stdout: "✔ bootstrap finished"}},
+			attempts:  2,
+		},
+		{
+			name:      "fatal failure not retried",
+			retries:   2,
+			bootstrap: []ExecResult{{Stderr: "✗ failed to push: authentication required", ExitCode: 1}},
+			attempts:  1,
+			wantErr:   "authentication required",
+		},
+		{
+			name:      "retries exhausted",
+			retries:   2,
+			bootstrap: []ExecResult{unavailable},
+			attempts:  3,
+			wantErr:   "flux bootstrap failed 3 time(s)",
+		},
+		{
+			name:      "no retries configured",
+			bootstrap: []ExecResult{unavailable},
+			attempts:  1,
+			wantErr:   "503 Service Unavailable",
+		},
+		{
+			name:      "failure past the sync",
+			retries:   2,
+			bootstrap: []ExecResult{unavailable},
+			synced:    true,
+			attempts:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crd, ready := ExecResult{}, "False"
+			if tt.synced {
+				crd, ready = ExecResult{Stdout: fluxCRDFound}, "True"
+			}
+			e := script(
+				step("test -d", ExecResult{Stdout: "found\n"}),
+				step("if [ ! -d", ExecResult{Stdout: "missing\n"}),
+				step("flux bootstrap", tt.bootstrap...),
+				step(fluxCRDLookup, crd),
+				step("get gitrepositories", ExecResult{Stdout: `{"items": [{"status": {"conditions": [{"type": "Ready", "status": "` + ready + `"}]}}]}`}),
+				step("flux check --pre", ExecResult{Stdout: "✔ prerequisites checks passed"}),
+				step("get deployments -n flux-system -o name"),
+			)
+			cfg := Config{
+				GitToken:              "token",
+				Bootstrap:             BootstrapConfig{Path: "clusters/ci"},
+				BootstrapRetries:      tt.retries,
+				BootstrapRetryBackoff: time.Millisecond,
+			}
+			err := NewOfflineInstance(context.Background(), cfg, e).bootstrap()
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("bootstrap() error = %v, want %q", err, tt.wantErr)
+			}
+			if got := e.count("flux bootstrap"); got != tt.attempts {
+				t.Errorf("ran flux bootstrap %d time(s), want %d", got, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestRecoverableBootstrapError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "rate limit", err: &CommandError{ExecResult: ExecResult{Stderr: "API rate limit exceeded", ExitCode: 1}}, want: true},
+		{name: "webhook not serving", err: &CommandError{ExecResult: ExecResult{Stdout: "dial tcp 10.43.0.1:443: connect: connection refused", ExitCode: 1}}, want: true},
+		{name: "bad credentials", err: &CommandError{ExecResult: ExecResult{Stderr: "401 Bad credentials", ExitCode: 1}}},
+		{name: "not a command failure", err: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := recoverableBootstrapError(tt.err); got != tt.want {
+				t.Errorf("recoverableBootstrapError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package k3sflux
+
+import (
+	"context"
+	"fmt"
+
+	"dagger.io/dagger"
+)
+
+const (
+	// configCacheKey names the cache volume k3s writes its kubeconfig to.
+	configCacheKey = "k3s_config"
+	// dataCacheKey names the cache volume holding the k3s datastore when
+	// Config.PersistData is set.
+	dataCacheKey = "k3s_data"
+	// agentLogsCacheKey names the cache volume the agents log to when
+	// Config.Agents is set.
+	agentLogsCacheKey = "k3s_agent_logs"
+)
+
+// configCacheName is the config cache volume of the instance called name,
+// keeping instances with distinct Config.Name apart.
+func configCacheName(name string) string {
+	return cacheName(configCacheKey, name)
+}
+
+// dataCacheName is the data cache volume of the instance called name.
+func dataCacheName(name string) string {
+	return cacheName(dataCacheKey, name)
+}
+
+func cacheName(key, name string) string {
+	if name == "" {
+		return key
+	}
+	return key + "_" + name
+}
+
+// Cleanup empties the config cache volume of the instance, dropping the
+// kubeconfig a previous k3s server left there. A restarted server issues new
+// credentials, so copying the stale file fails with confusing authentication
+// errors; start calls it first when Config.ResetConfigCache is set. Cleanup
+// only touches the volume, not a running cluster, so it is safe to defer on
+// shutdown and to call more than once.
+func (k *K8sInstance) Cleanup() error {
+	c := k.sessionContainer(func() *dagger.Container {
+		return k.from(toolsImage).
+			WithMountedCache("/cache/k3s", k.configCache).
+			WithEntrypoint([]string{"sh", "-c"})
+	})
+	if _, err := k.execIn(c, "cleanup", "find /cache/k3s -mindepth 1 -delete", true); err != nil {
+		return fmt.Errorf("failed to clear the k3s config cache: %w", err)
+	}
+	return nil
+}
+
+// PruneCaches empties the cache volumes created by this tool: k3s_config
+// holding the k3s kubeconfig, k3s_data holding a persisted datastore and
+// k3s_agent_logs holding the agent logs, plus the ones of the named
+// instances (see Config.Name). Dagger offers no API to remove a volume, so
+// the volumes stay registered with the engine but hold no data afterwards.
+// Volumes that were never created are simply created empty. The volumes are
+// emptied through a DaggerExecutor, there is no instance to take one from.
+func PruneCaches(ctx context.Context, client *dagger.Client, names ...string) error {
+	keys := []string{configCacheKey, dataCacheKey, agentLogsCacheKey}
+	for _, name := range names {
+		keys = append(keys, configCacheName(name), dataCacheName(name), cacheName(agentLogsCacheKey, name))
+	}
+	for _, key := range keys {
+		c := client.Container().
+			From(toolsImage).
+			WithMountedCache("/cache", client.CacheVolume(key)).
+			WithEntrypoint([]string{"sh", "-c"})
+		if _, err := (DaggerExecutor{}).Exec(ctx, c, "prune caches", "find /cache -mindepth 1 -delete", true); err != nil {
+			return fmt.Errorf("failed to prune cache %s: %w", key, err)
+		}
+	}
+	return nil
+}
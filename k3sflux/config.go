@@ -0,0 +1,378 @@
+package k3sflux
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// Config holds the knobs that change how the cluster and tools container are
+// assembled. DefaultConfig returns the default behavior; the zero value only
+// differs from it by showing secret values in diffs.
+type Config struct {
+	// Name tells apart instances running side by side, e.g. in RunMatrix.
+	// It suffixes the config cache volume and the k3s service alias.
+	Name string
+	// Rootless skips the root user switches and the kubeconfig chown, for
+	// Dagger engines that block root operations. The kubeconfig copied from
+	// the k3s cache must then be readable by the default user.
+	Rootless bool
+	// K3s chooses the packaged components k3s deploys.
+	K3s K3sOptions
+	// ExtraK3sServerArgs are appended to the k3s server command.
+	ExtraK3sServerArgs []string
+	// K3sVersion pins the k3s image, either as a tag of rancher/k3s such as
+	// v1.28.5-k3s1 or as a full image reference used verbatim. Empty uses
+	// a known good pinned tag.
+	K3sVersion string
+	// ToolImages are the images the kubectl, helm and flux binaries of the
+	// tools container are copied from.
+	ToolImages ToolImages
+	// Platform is the platform of every container, e.g. linux/arm64. Empty
+	// uses the platform of the Dagger engine host.
+	Platform string
+	// WaitRetries is how many times start checks for a Ready node before
+	// giving up, 5 when zero.
+	WaitRetries int
+	// WaitBackoff is the pause before each of those checks, 5s when zero.
+	WaitBackoff time.Duration
+	// Agents is the number of k3s agents joining the server, for tests
+	// spreading workloads over nodes.
+	Agents int
+	// AgentJoinTimeout bounds the wait for the agents to be Ready nodes,
+	// two minutes when zero.
+	AgentJoinTimeout time.Duration
+	// OnAgentJoinFailure decides what to do when agents did not join in
+	// time.
+	OnAgentJoinFailure AgentJoinPolicy
+	// PersistData keeps the k3s datastore in a cache volume instead of a
+	// temporary mount, so a later run starts from the same cluster.
+	PersistData bool
+	// OnExistingCluster decides what to do when PersistData finds the
+	// datastore of a previous run.
+	OnExistingCluster ExistingClusterPolicy
+	// FeatureGates are enabled or disabled on both kube-apiserver and the
+	// kubelet, merged with any feature-gates set through ExtraK3sServerArgs.
+	FeatureGates map[string]bool
+	// Bootstrap is the repository flux is bootstrapped from and diffed
+	// against.
+	Bootstrap BootstrapConfig
+	// GitToken authenticates the clone of the repository and flux bootstrap.
+	GitToken string
+	// GitTokenFile, when set, is read by Execute through WithGitTokenFile.
+	GitTokenFile string
+	// BootstrapAuth is how the repository is cloned and flux bootstrapped.
+	// Execute passes SSHPrivateKeyFile and SSHKnownHostsFile to WithSSHAuth
+	// when it is BootstrapAuthSSH.
+	BootstrapAuth     BootstrapAuth
+	SSHPrivateKeyFile string
+	SSHKnownHostsFile string
+	// RegistryMirrors maps registry hosts to the mirror endpoint Execute
+	// passes to WithRegistryMirror, e.g. docker.io to a pull-through cache.
+	RegistryMirrors map[string]string
+	// RegistryTLS maps registry hosts to the TLS settings Execute passes to
+	// WithRegistryTLS, e.g. the host of a mirror signed by a private CA.
+	RegistryTLS map[string]RegistryTLS
+	// StrictPaths turns a bootstrap path missing from the repository into an
+	// error instead of a warning.
+	StrictPaths bool
+	// OnMissingRef decides what to do when the diff branch does not exist.
+	OnMissingRef MissingRefPolicy
+	// BootstrapTimeout is passed to flux bootstrap as --timeout, bounding how
+	// long it waits for the initial reconciliation. Zero keeps the flux
+	// default.
+	BootstrapTimeout time.Duration
+	// BootstrapRetries is how many times a bootstrap failing on a transient
+	// error, such as a GitHub rate limit or a 5xx, or flux controllers not
+	// ready yet on a fresh cluster, is run again. Other failures are
+	// returned right away.
+	BootstrapRetries int
+	// BootstrapRetryBackoff is the pause before each retry, 15s when zero.
+	BootstrapRetryBackoff time.Duration
+	// BootstrapRetryTimeout bounds the wait for each flux controller to
+	// roll out before a retry, two minutes when zero.
+	BootstrapRetryTimeout time.Duration
+	// ComponentsExtra lists optional flux controllers to install on
+	// bootstrap, e.g. image-reflector-controller and
+	// image-automation-controller for image automation tests.
+	ComponentsExtra []string
+	// BootstrapKustomization is a kustomization patching the gotk
+	// components, e.g. to raise controller resources or enable feature
+	// gates, handed to flux bootstrap through --kustomization.
+	BootstrapKustomization *dagger.File
+	// FluxResourceProfile patches the flux controller resource requests on
+	// bootstrap. It uses the --kustomization mechanism and cannot be combined
+	// with BootstrapKustomization.
+	FluxResourceProfile FluxResourceProfile
+	// DiffTargets are the kustomizations diffed by Run, defaulting to
+	// infra-custom, apps and flux-system.
+	DiffTargets []DiffTarget
+	// DiffSelector is a label selector, e.g. team=payments. When set, Run
+	// diffs the in-cluster Kustomizations matching it instead of DiffTargets.
+	DiffSelector string
+	// PrePullImages are pulled onto every node by Run before bootstrap, so
+	// large images do not make the first reconciliation time out.
+	PrePullImages []string
+	// PolicyChecks are evaluated by Run with EvaluatePolicies after the
+	// diffs. Their violations are reported, they do not fail the run.
+	PolicyChecks []PolicyCheck
+	// GreenfieldDiff reports every object of a diff target as created when
+	// its Kustomization is not in the cluster yet, instead of failing the
+	// diff, e.g. to validate a repository before anything is installed.
+	GreenfieldDiff bool
+	// TolerateMissingCRDs diffs a target holding custom resources whose CRD
+	// is not installed yet without them, listing them as CRDPending instead
+	// of failing the diff, since an earlier kustomization in dependency
+	// order may install the CRD.
+	TolerateMissingCRDs bool
+	// DiffIgnoreAnnotations drops from the diff results every object whose
+	// live version carries one of these annotations with the same value, e.g.
+	// kustomize.toolkit.fluxcd.io/reconcile: disabled. Ignored objects do not
+	// count as drift.
+	DiffIgnoreAnnotations map[string]string
+	// StripFluxMetadata removes the kustomize.toolkit.fluxcd.io and
+	// helm.toolkit.fluxcd.io labels and annotations from both sides of
+	// DiffAgainstApplied, so manifests exported from the cluster do not show
+	// spurious metadata changes.
+	StripFluxMetadata bool
+	// MaskSecrets replaces the values of changed Secret data in the diff
+	// output, keeping the Secret itself reported as changed so it still
+	// counts as drift.
+	MaskSecrets bool
+	// OrphanSkipKinds are kinds FindOrphans never reports, defaulting to the
+	// ones Kubernetes creates on its own such as Event and EndpointSlice.
+	OrphanSkipKinds []string
+	// CleanupGitCommits resets the bootstrap branch to its pre-run commit
+	// after a successful run, dropping the commits flux pushed to it. See
+	// CleanupGitCommits for the safeguards.
+	CleanupGitCommits bool
+	// CleanupGitAuthors are commit authors CleanupGitCommits drops commits
+	// of, on top of flux bootstrap and the ImageUpdateAutomation authors,
+	// e.g. a CI bot pushing test fixtures.
+	CleanupGitAuthors []string
+	// FailOnDiff makes the process exit non-zero when a diff target
+	// drifted, turning the run into a CI gate.
+	FailOnDiff bool
+	// FailOnWarnings makes the process exit non-zero when the run completed
+	// with warnings, e.g. a skipped diff target.
+	FailOnWarnings bool
+	// SystemPodsTimeout makes Run wait that long for the kube-system pods to
+	// be ready before bootstrapping, and for the flux-system pods too before
+	// waiting on the apps. Zero skips both waits.
+	SystemPodsTimeout time.Duration
+	// PendingPodAllowlist holds pod name prefixes allowed to stay pending
+	// while waiting for the system pods.
+	PendingPodAllowlist []string
+	// ResetConfigCache empties the k3s_config cache volume before the
+	// cluster starts and again once Execute is done, see Cleanup. Leaving it
+	// off reuses the volume between runs.
+	ResetConfigCache bool
+	// WorkDir is the working directory of the commands run in the tools
+	// container, /tmp when empty, where flux build and kustomize write
+	// their temporary files. It is a temporary mount, so those files never
+	// end up in the Dagger cache.
+	WorkDir string
+	// KubeconfigPath, when set, is where Run exports the kubeconfig of the
+	// cluster once it started, see ExportKubeconfig.
+	KubeconfigPath string
+	// DiagnosticsDir, when set, is where a failed Run writes the state of
+	// the cluster, see collectDiagnostics.
+	DiagnosticsDir string
+	// LogsDir, when set, is where Execute writes the output of each
+	// pipeline through ExportLogs.
+	LogsDir string
+	// LogOutput receives the Dagger engine progress, os.Stderr when nil.
+	LogOutput io.Writer
+}
+
+// ToolImages are the image references the tools container binaries come
+// from. Empty fields use the defaults. A replacement image must ship its
+// binary at the path of the default one: /opt/bitnami/kubectl/bin/kubectl,
+// /usr/bin/helm and /usr/local/bin/flux.
+type ToolImages struct {
+	Kubectl string
+	Helm    string
+	Flux    string
+}
+
+// withDefaults fills the empty fields with the default images.
+func (t ToolImages) withDefaults() ToolImages {
+	if t.Kubectl == "" {
+		t.Kubectl = kubectlImage
+	}
+	if t.Helm == "" {
+		t.Helm = helmImage
+	}
+	if t.Flux == "" {
+		t.Flux = fluxImage
+	}
+	return t
+}
+
+// K3sOptions are the k3s packaged components to deploy. The zero value
+// disables traefik and metrics-server, which the diffs do not need, and keeps
+// servicelb.
+type K3sOptions struct {
+	// EnableTraefik deploys the traefik ingress controller.
+	EnableTraefik bool
+	// EnableMetricsServer deploys metrics-server, e.g. to test
+	// HorizontalPodAutoscalers.
+	EnableMetricsServer bool
+	// DisableServiceLB leaves out servicelb, the LoadBalancer service
+	// controller.
+	DisableServiceLB bool
+}
+
+// disableArgs are the --disable flags of the k3s server command.
+func (o K3sOptions) disableArgs() []string {
+	var args []string
+	if !o.EnableTraefik {
+		args = append(args, "--disable traefik")
+	}
+	if !o.EnableMetricsServer {
+		args = append(args, "--disable metrics-server")
+	}
+	if o.DisableServiceLB {
+		args = append(args, "--disable servicelb")
+	}
+	return args
+}
+
+// RegistryTLS is how containerd verifies the certificate of a registry.
+type RegistryTLS struct {
+	// CAFile is a PEM file on the host holding the CA of the registry.
+	CAFile             string
+	InsecureSkipVerify bool
+}
+
+// BootstrapConfig is the GitHub repository flux is bootstrapped from. Empty
+// fields fall back to the Shaked/fluxcd-test test repository.
+type BootstrapConfig struct {
+	// Hostname is the GitHub host, e.g. the one of a GitHub Enterprise
+	// server. Defaults to github.com.
+	Hostname   string
+	Owner      string
+	Repository string
+	// Branch is the branch flux syncs from.
+	Branch string
+	// Path is the cluster directory in the repository, passed to flux
+	// bootstrap as --path.
+	Path string
+	// Cluster, when Path is empty, bootstraps the clusters/<Cluster>
+	// directory of a repository managing several clusters.
+	Cluster string
+	// GitRef is the branch holding the changes to diff, e.g. a pull request
+	// branch compared against Branch. Empty diffs Branch itself, so the diff
+	// source and the cluster track the same tree.
+	GitRef string
+}
+
+// withDefaults fills the empty fields with the defaults.
+func (b BootstrapConfig) withDefaults() BootstrapConfig {
+	if b.Hostname == "" {
+		b.Hostname = defaultGitHubHost
+	}
+	if b.Owner == "" {
+		b.Owner = "Shaked"
+	}
+	if b.Repository == "" {
+		b.Repository = "fluxcd-test"
+	}
+	if b.Branch == "" {
+		b.Branch = "main"
+	}
+	if b.Path == "" && b.Cluster != "" {
+		b.Path = "clusters/" + b.Cluster
+	}
+	if b.Path == "" {
+		b.Path = "clusters/tests"
+	}
+	if b.GitRef == "" {
+		b.GitRef = b.Branch
+	}
+	return b
+}
+
+// defaultGitHubHost is the GitHub host when BootstrapConfig.Hostname is
+// empty.
+const defaultGitHubHost = "github.com"
+
+// repo is the repository without scheme, e.g. github.com/Shaked/fluxcd-test.
+func (b BootstrapConfig) repo() string {
+	return fmt.Sprintf("%s/%s/%s", b.Hostname, b.Owner, b.Repository)
+}
+
+// cloneURL is the repository authenticated with token.
+func (b BootstrapConfig) cloneURL(token string) string {
+	return fmt.Sprintf("https://oauth2:%s@%s.git", token, b.repo())
+}
+
+// shellURL is cloneURL for commands run in the tools container, reading the
+// token from its environment so it stays out of the logs.
+func (b BootstrapConfig) shellURL() string {
+	return `"https://oauth2:${GITHUB_TOKEN}@` + b.repo() + `.git"`
+}
+
+// sshURL is the repository for key authentication, e.g.
+// ssh://git@github.com/Shaked/fluxcd-test.git.
+func (b BootstrapConfig) sshURL() string {
+	return fmt.Sprintf("ssh://git@%s.git", b.repo())
+}
+
+// DefaultConfig returns the configuration of a default run.
+func DefaultConfig() Config {
+	return Config{MaskSecrets: true}
+}
+
+// MissingRefPolicy decides what happens when the diff branch does not exist
+// in the repository.
+type MissingRefPolicy int
+
+const (
+	// MissingRefError fails early, listing the available branches.
+	MissingRefError MissingRefPolicy = iota
+	// MissingRefFallbackDefault clones the default branch instead.
+	MissingRefFallbackDefault
+)
+
+// BootstrapAuth is how the repository is authenticated to.
+type BootstrapAuth int
+
+const (
+	// BootstrapAuthToken uses the GitHub token over https and flux
+	// bootstrap github.
+	BootstrapAuthToken BootstrapAuth = iota
+	// BootstrapAuthSSH uses the key set by WithSSHAuth, e.g. a deploy key,
+	// over ssh and flux bootstrap git.
+	BootstrapAuthSSH
+)
+
+// AgentJoinPolicy decides what happens when some agents do not join the
+// cluster in time.
+type AgentJoinPolicy int
+
+const (
+	// AgentJoinFail fails the start, reporting the missing agents with the
+	// end of their logs.
+	AgentJoinFail AgentJoinPolicy = iota
+	// AgentJoinProceed carries on with the nodes that joined and records
+	// the missing agents as a warning.
+	AgentJoinProceed
+)
+
+// ExistingClusterPolicy decides what happens when the persisted k3s data
+// cache already holds a cluster.
+type ExistingClusterPolicy int
+
+const (
+	// ExistingClusterReuse starts k3s on the existing datastore after
+	// removing the locks left by a server that did not shut down, and starts
+	// from an empty one when the reused cluster does not become ready.
+	ExistingClusterReuse ExistingClusterPolicy = iota
+	// ExistingClusterReset wipes the datastore before starting.
+	ExistingClusterReset
+	// ExistingClusterError fails instead of touching the existing cluster.
+	ExistingClusterError
+)
@@ -0,0 +1,84 @@
+package k3sflux
+
+import (
+	"fmt"
+	"time"
+)
+
+// rootKustomization is the Kustomization flux bootstrap creates, applying
+// everything else in the repository.
+const rootKustomization = "flux-system/flux-system"
+
+// convergencePollInterval is the pause between two convergence checks.
+const convergencePollInterval = 10 * time.Second
+
+// kustomizationTree returns the root and every Kustomization it applies,
+// directly or through other Kustomizations, in breadth first order. Children
+// are found through the inventories, so a node whose parent has not applied
+// it yet is simply not part of the tree.
+func kustomizationTree(root string, items []kustomization) []kustomization {
+	byKey := make(map[string]kustomization, len(items))
+	for _, ks := range items {
+		byKey[ks.key()] = ks
+	}
+	var tree []kustomization
+	seen := map[string]bool{}
+	queue := []string{root}
+	for len(queue) > 0 {
+		key := queue[0]
+		queue = queue[1:]
+		ks, ok := byKey[key]
+		if !ok || seen[key] {
+			continue
+		}
+		seen[key] = true
+		tree = append(tree, ks)
+		for _, ref := range ks.inventory() {
+			if ref.Kind == "Kustomization" {
+				queue = append(queue, ref.Namespace+"/"+ref.Name)
+			}
+		}
+	}
+	return tree
+}
+
+// WaitForConvergence waits for the root flux-system Kustomization and all
+// its descendants to be Ready, meaning the whole repository is reconciled.
+// On timeout the first node that did not converge is returned with its
+// reason.
+func (k *K8sInstance) WaitForConvergence(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		pending, err := k.notConverged()
+		if err != nil {
+			return err
+		}
+		if pending == nil {
+			return nil
+		}
+		if time.Now().Add(convergencePollInterval).After(deadline) {
+			ready := pending.readyCondition()
+			return fmt.Errorf("kustomization %s did not converge within %v: %s: %s", pending.key(), timeout, ready.Reason, ready.Message)
+		}
+		time.Sleep(convergencePollInterval)
+	}
+}
+
+// notConverged returns the first Kustomization of the tree that is not
+// Ready, or nil once all of them are.
+func (k *K8sInstance) notConverged() (*kustomization, error) {
+	items, err := k.kustomizations()
+	if err != nil {
+		return nil, err
+	}
+	tree := kustomizationTree(rootKustomization, items)
+	if len(tree) == 0 {
+		return nil, fmt.Errorf("root kustomization %s not found", rootKustomization)
+	}
+	for i := range tree {
+		if tree[i].readyCondition().Status != "True" {
+			return &tree[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,89 @@
+package k3sflux
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// crdPendingDir holds the rendered target diffWithoutMissingCRDs diffs,
+// under the work dir.
+const crdPendingDir = "crd-pending"
+
+// diffWithoutMissingCRDs renders target, sets aside the objects whose kind
+// the API server does not serve and flux diffs the rest, returning the
+// objects set aside as created with their CRD pending. Flux applies the
+// Kustomization patches and substitutions on top of the rendered objects
+// like it does on the repository files.
+func (k *K8sInstance) diffWithoutMissingCRDs(c *dagger.Container, name string, target DiffTarget) (ExecResult, []DiffEntry, error) {
+	rendered, err := k.execIn(c, name, "kubectl kustomize "+shellQuote(target.sourcePath()), false)
+	if err != nil {
+		return rendered, nil, fmt.Errorf("failed to render %s: %w", target.sourcePath(), err)
+	}
+	served, err := k.servedKinds(c, name)
+	if err != nil {
+		return ExecResult{}, nil, err
+	}
+	var kept []string
+	var pending []DiffEntry
+	for _, doc := range strings.Split(rendered.Stdout, "\n---\n") {
+		apiVersion, kind := typeOf(doc)
+		if kind == "" || served[apiVersion+"/"+kind] {
+			kept = append(kept, doc)
+			continue
+		}
+		for _, ref := range parseRenderedObjects(doc) {
+			if group, _, ok := strings.Cut(apiVersion, "/"); ok {
+				ref.Group = group
+			}
+			pending = append(pending, DiffEntry{ResourceRef: ref, Action: "created (CRD pending)"})
+		}
+	}
+	if len(pending) == 0 {
+		return ExecResult{}, nil, fmt.Errorf("flux diff reported a missing kind but every rendered kind is served")
+	}
+	if len(kept) == 0 {
+		return ExecResult{}, pending, nil
+	}
+	dir := path.Join(k.workDir(), crdPendingDir, target.Name)
+	// an offline instance has no container, its Executor does not read the
+	// files
+	if c != nil {
+		c = c.WithNewFile(path.Join(dir, "resources.yaml"), dagger.ContainerWithNewFileOpts{Contents: strings.Join(kept, "\n---\n")}).
+			WithNewFile(path.Join(dir, "kustomization.yaml"), dagger.ContainerWithNewFileOpts{Contents: "resources:\n- resources.yaml\n"})
+	}
+	res, err := k.execIn(c, name, "flux "+diffCommand(target, dir), true)
+	return res, pending, err
+}
+
+// servedKinds lists the apiVersion/Kind pairs the API server serves, e.g.
+// apps/v1/Deployment.
+func (k *K8sInstance) servedKinds(c *dagger.Container, name string) (map[string]bool, error) {
+	res, err := k.execIn(c, name, "kubectl api-resources --no-headers", true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover resource types: %w", err)
+	}
+	served := map[string]bool{}
+	for _, line := range strings.Split(res.Stdout, "\n") {
+		// NAME [SHORTNAMES] APIVERSION NAMESPACED KIND
+		fields := strings.Fields(line)
+		if len(fields) >= 4 {
+			served[fields[len(fields)-3]+"/"+fields[len(fields)-1]] = true
+		}
+	}
+	return served, nil
+}
+
+// typeOf returns the top level apiVersion and kind of a rendered object.
+func typeOf(doc string) (apiVersion, kind string) {
+	for _, line := range strings.Split(doc, "\n") {
+		if v, ok := strings.CutPrefix(line, "apiVersion: "); ok {
+			apiVersion = strings.TrimSpace(v)
+		} else if v, ok := strings.CutPrefix(line, "kind: "); ok {
+			kind = strings.TrimSpace(v)
+		}
+	}
+	return apiVersion, kind
+}
@@ -0,0 +1,67 @@
+package k3sflux
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestDiffTolerateMissingCRDs(t *testing.T) {
+	rendered := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: apps
+---
+apiVersion: monitoring.coreos.com/v1
+kind: ServiceMonitor
+metadata:
+  name: web
+  namespace: apps
+`
+	recorded := RecordedExecutor{
+		"flux diff kustomization apps --path /src/apps": {
+			Stderr:   `✗ no matches for kind "ServiceMonitor" in version "monitoring.coreos.com/v1"`,
+			ExitCode: 1,
+		},
+		"kubectl kustomize '/src/apps'":      {Stdout: rendered},
+		"kubectl api-resources --no-headers": {Stdout: "deployments   deploy   apps/v1   true   Deployment\nnamespaces   ns   v1   false   Namespace\n"},
+		"flux diff kustomization apps --path /tmp/crd-pending/apps": {
+			Stdout:   "► Deployment/apps/web drifted\n",
+			ExitCode: 1,
+		},
+	}
+	k := NewOfflineInstance(context.Background(), Config{TolerateMissingCRDs: true}, recorded)
+	d, err := k.Diff(DiffTarget{Name: "apps", Path: "apps"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := []DiffEntry{{ResourceRef: ResourceRef{Kind: "Deployment", Namespace: "apps", Name: "web"}, Action: "drifted"}}
+	if !reflect.DeepEqual(d.Changes, changes) {
+		t.Errorf("changes = %+v, want %+v", d.Changes, changes)
+	}
+	pending := []DiffEntry{{ResourceRef: ResourceRef{Group: "monitoring.coreos.com", Kind: "ServiceMonitor", Namespace: "apps", Name: "web"}, Action: "created (CRD pending)"}}
+	if !reflect.DeepEqual(d.CRDPending, pending) {
+		t.Errorf("CRDPending = %+v, want %+v", d.CRDPending, pending)
+	}
+
+	// without the option the missing CRD fails the diff
+	k = NewOfflineInstance(context.Background(), Config{}, recorded)
+	if _, err := k.Diff(DiffTarget{Name: "apps", Path: "apps"}); err == nil {
+		t.Error("Diff succeeded without TolerateMissingCRDs")
+	}
+}
+
+func TestServedKinds(t *testing.T) {
+	k := NewOfflineInstance(context.Background(), Config{}, RecordedExecutor{
+		"kubectl api-resources --no-headers": {Stdout: "configmaps   cm   v1   true   ConfigMap\nkustomizations   ks   kustomize.toolkit.fluxcd.io/v1   true   Kustomization\nbindings      v1   true   Binding\n\n"},
+	})
+	served, err := k.servedKinds(nil, "diff-apps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"v1/ConfigMap": true, "kustomize.toolkit.fluxcd.io/v1/Kustomization": true, "v1/Binding": true}
+	if !reflect.DeepEqual(served, want) {
+		t.Errorf("servedKinds() = %v, want %v", served, want)
+	}
+}
@@ -0,0 +1,76 @@
+package k3sflux
+
+import (
+	"fmt"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const (
+	// k3sDataDir is where k3s keeps its datastore, certificates and images.
+	k3sDataDir = "/var/lib/rancher/k3s"
+	// k3sStateDB is the sqlite datastore of a k3s server, relative to
+	// k3sDataDir. Its presence tells a previous cluster lives in the cache.
+	k3sStateDB = "server/db/state.db"
+)
+
+// dataMount mounts the k3s data directory, from the data cache volume when
+// Config.PersistData is set.
+func (k *K8sInstance) dataMount(c *dagger.Container) *dagger.Container {
+	if !k.cfg.PersistData {
+		return c.WithMountedTemp(k3sDataDir)
+	}
+	return c.WithMountedCache(k3sDataDir, k.dataCache())
+}
+
+func (k *K8sInstance) dataCache() *dagger.CacheVolume {
+	return k.client.CacheVolume(dataCacheName(k.cfg.Name))
+}
+
+// dataCacheExec runs a shell command on the data cache volume, mounted at
+// /data in a throwaway container.
+func (k *K8sInstance) dataCacheExec(name, command string) (string, error) {
+	c := k.sessionContainer(func() *dagger.Container {
+		return k.from(toolsImage).
+			WithMountedCache("/data", k.dataCache()).
+			WithEntrypoint([]string{"sh", "-c"})
+	})
+	return stdout(k.execIn(c, name, command, true))
+}
+
+// prepareDataCache applies Config.OnExistingCluster to the persisted
+// datastore and reports whether start is about to reuse an existing
+// cluster.
+func (k *K8sInstance) prepareDataCache() (bool, error) {
+	if !k.cfg.PersistData {
+		return false, nil
+	}
+	out, err := k.dataCacheExec("k3s data", fmt.Sprintf("if [ -e /data/%s ]; then echo existing; fi", k3sStateDB))
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect the k3s data cache: %w", err)
+	}
+	if strings.TrimSpace(out) != "existing" {
+		return false, nil
+	}
+	switch k.cfg.OnExistingCluster {
+	case ExistingClusterError:
+		return false, fmt.Errorf("k3s data cache %s already holds a cluster", dataCacheName(k.cfg.Name))
+	case ExistingClusterReset:
+		return false, k.wipeDataCache()
+	}
+	// a server killed mid run leaves its sqlite lock files and sockets
+	// behind, which make the next one refuse to start
+	if _, err := k.dataCacheExec("k3s data", "find /data/server -name '*.lock' -o -name '*.sock' | xargs -r rm -f"); err != nil {
+		return false, fmt.Errorf("failed to clean stale locks from the k3s data cache: %w", err)
+	}
+	return true, nil
+}
+
+// wipeDataCache empties the persisted datastore.
+func (k *K8sInstance) wipeDataCache() error {
+	if _, err := k.dataCacheExec("k3s data", "find /data -mindepth 1 -delete"); err != nil {
+		return fmt.Errorf("failed to wipe the k3s data cache: %w", err)
+	}
+	return nil
+}
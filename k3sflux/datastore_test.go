@@ -0,0 +1,65 @@
+package k3sflux
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestPrepareDataCache(t *testing.T) {
+	const (
+		inspect   = "if [ -e /data/server/db/state.db ]; then echo existing; fi"
+		dropLocks = "find /data/server -name '*.lock' -o -name '*.sock' | xargs -r rm -f"
+		wipe      = "find /data -mindepth 1 -delete"
+	)
+	tests := []struct {
+		name     string
+		cfg      Config
+		existing bool
+		reused   bool
+		commands []string
+		wantErr  bool
+	}{
+		{name: "not persisted", cfg: Config{OnExistingCluster: ExistingClusterReset}},
+		{name: "empty cache", cfg: Config{PersistData: true}, commands: []string{inspect}},
+		{
+			name:     "reuse",
+			cfg:      Config{PersistData: true, OnExistingCluster: ExistingClusterReuse},
+			existing: true,
+			reused:   true,
+			commands: []string{inspect, dropLocks},
+		},
+		{
+			name:     "reset",
+			cfg:      Config{PersistData: true, OnExistingCluster: ExistingClusterReset},
+			existing: true,
+			commands: []string{inspect, wipe},
+		},
+		{
+			name:     "error",
+			cfg:      Config{PersistData: true, OnExistingCluster: ExistingClusterError},
+			existing: true,
+			commands: []string{inspect},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found := ExecResult{}
+			if tt.existing {
+				found.Stdout = "existing\n"
+			}
+			e := script(step(inspect, found), step(dropLocks), step(wipe))
+			reused, err := NewOfflineInstance(context.Background(), tt.cfg, e).prepareDataCache()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("prepareDataCache() error = %v, want error %v", err, tt.wantErr)
+			}
+			if reused != tt.reused {
+				t.Errorf("prepareDataCache() reused = %v, want %v", reused, tt.reused)
+			}
+			if !reflect.DeepEqual(e.commands, tt.commands) {
+				t.Errorf("commands = %q, want %q", e.commands, tt.commands)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package k3sflux
+
+import (
+	"fmt"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// diagnosticCommand is a command collectDiagnostics runs, with the name of
+// the file its output goes to.
+type diagnosticCommand struct {
+	name    string
+	command string
+}
+
+var diagnosticCommands = []diagnosticCommand{
+	{"nodes", "kubectl get nodes -o wide"},
+	{"events", "kubectl get events -A --sort-by=.lastTimestamp"},
+	{"pods", "kubectl get pods -A -o wide"},
+	{"describe-pods", "kubectl describe pods -A"},
+	{"deployments", "kubectl get deployments -A -o wide"},
+	{"flux-get-all", "flux get all -A"},
+}
+
+// diagnosticLogControllers are the flux-system controllers whose logs are
+// collected on their own.
+var diagnosticLogControllers = []string{"source-controller", "kustomize-controller", "helm-controller", "notification-controller"}
+
+// collectDiagnostics gathers the state of the cluster for a post-mortem, one
+// file per command. Every command is best effort: a failure is written to
+// its file in place of the output and the collection goes on.
+func (k *K8sInstance) collectDiagnostics() (*dagger.Directory, error) {
+	if err := k.requireSession("collectDiagnostics"); err != nil {
+		return nil, err
+	}
+	dir := k.client.Directory()
+	if k.container == nil {
+		return dir.WithNewFile("README.txt", "the cluster was not started, there is nothing to collect\n"), nil
+	}
+	commands := append([]diagnosticCommand{}, diagnosticCommands...)
+	for _, controller := range diagnosticLogControllers {
+		commands = append(commands, diagnosticCommand{
+			name:    "logs-" + controller,
+			command: fmt.Sprintf("kubectl logs -n flux-system deployment/%s --all-containers --tail=500", controller),
+		})
+	}
+	for _, c := range commands {
+		res, err := k.exec("diagnostics", c.command, true)
+		var b strings.Builder
+		fmt.Fprintf(&b, "$ %s\n%s", c.command, res.Stdout)
+		if res.Stderr != "" {
+			b.WriteString(res.Stderr)
+		}
+		if err != nil {
+			fmt.Fprintf(&b, "\nfailed: %v\n", err)
+		}
+		dir = dir.WithNewFile(c.name+".txt", b.String())
+	}
+	return dir, nil
+}
+
+// exportDiagnostics writes collectDiagnostics to the host directory p.
+func (k *K8sInstance) exportDiagnostics(p string) error {
+	dir, err := k.collectDiagnostics()
+	if err != nil {
+		return err
+	}
+	if _, err := dir.Export(k.ctx, p); err != nil {
+		return fmt.Errorf("failed to export diagnostics to %s: %w", p, err)
+	}
+	return nil
+}
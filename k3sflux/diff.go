@@ -0,0 +1,423 @@
+package k3sflux
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// DiffTarget is a kustomization to diff together with the repository path
+// holding its desired state.
+type DiffTarget struct {
+	Name string
+	// Namespace of the Kustomization, flux-system when empty.
+	Namespace string
+	Path      string
+	// SourceRoot is the directory Path is relative to, overriding the cloned
+	// repository mount for monorepos whose kustomizations live under
+	// different bases.
+	SourceRoot string
+}
+
+// sourcePath is the directory holding the desired state of the target.
+func (t DiffTarget) sourcePath() string {
+	root := t.SourceRoot
+	if root == "" {
+		root = srcDir
+	}
+	return path.Join(root, t.Path)
+}
+
+// sourcePathIn is sourcePath for a clone of the repository at repo. A
+// SourceRoot inside the cloned repository keeps its place in the clone; one
+// outside it, such as the WithLocalManifests directory, is taken for a copy
+// of the repository.
+func (t DiffTarget) sourcePathIn(repo string) string {
+	if rel, ok := strings.CutPrefix(t.SourceRoot, srcDir); ok && (rel == "" || rel[0] == '/') {
+		return path.Join(repo, rel, t.Path)
+	}
+	return path.Join(repo, t.Path)
+}
+
+// ResourceRef identifies a single Kubernetes object.
+type ResourceRef struct {
+	// Group is the API group, empty for core objects and when unknown.
+	Group     string
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+func (r ResourceRef) String() string {
+	if r.Namespace == "" {
+		return fmt.Sprintf("%s/%s", r.Kind, r.Name)
+	}
+	return fmt.Sprintf("%s/%s/%s", r.Kind, r.Namespace, r.Name)
+}
+
+// DiffEntry is a single object reported by flux diff.
+type DiffEntry struct {
+	ResourceRef
+	// Action is the flux verdict for the object: created, drifted or deleted.
+	Action string
+	// Detail holds the field level changes flux printed for the object.
+	Detail string
+}
+
+// FluxDiff is the parsed output of a flux diff kustomization run. Objects
+// that would be created or updated are kept apart from the ones that would
+// be pruned, since deletions are what deserve a second look during review.
+type FluxDiff struct {
+	Kustomization string
+	Path          string
+	Output        string
+	// ExitCode is the exit code of flux diff, 1 on drift.
+	ExitCode  int
+	Changes   []DiffEntry
+	Deletions []DiffEntry
+	// CRDPending are the objects left out of the diff with
+	// Config.TolerateMissingCRDs because their CRD is not installed. They
+	// would be created once it is and do not count as drift.
+	CRDPending []DiffEntry
+}
+
+// DriftDetected reports whether applying the target would change the cluster.
+func (d *FluxDiff) DriftDetected() bool {
+	return len(d.Changes) > 0 || len(d.Deletions) > 0
+}
+
+// Report renders the diff for humans, listing deletions last and loudly.
+func (d *FluxDiff) Report() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "kustomization %s (%s): ", d.Kustomization, d.Path)
+	if !d.DriftDetected() {
+		b.WriteString("no changes\n")
+		d.writePending(&b)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "%d change(s), %d deletion(s)\n", len(d.Changes), len(d.Deletions))
+	for _, e := range d.Changes {
+		fmt.Fprintf(&b, "  ~ %s %s\n", e.ResourceRef, e.Action)
+		if e.Detail != "" {
+			b.WriteString(indent(e.Detail, "      "))
+		}
+	}
+	if len(d.Deletions) > 0 {
+		fmt.Fprintf(&b, "  !! %d resource(s) would be DELETED (pruned):\n", len(d.Deletions))
+		for _, e := range d.Deletions {
+			fmt.Fprintf(&b, "  !! - %s\n", e.ResourceRef)
+		}
+	}
+	d.writePending(&b)
+	return b.String()
+}
+
+// writePending lists the CRDPending objects of the report.
+func (d *FluxDiff) writePending(b *strings.Builder) {
+	for _, e := range d.CRDPending {
+		fmt.Fprintf(b, "  ? %s %s\n", e.ResourceRef, e.Action)
+	}
+}
+
+// Diff runs flux diff for the target against the cloned repository and
+// splits the reported objects into changes and prune candidates. Flux only
+// reports deletions for kustomizations with pruning enabled, so an empty
+// Deletions list on a non-pruning kustomization means nothing is removed.
+func (k *K8sInstance) Diff(target DiffTarget) (*FluxDiff, error) {
+	return k.diffIn(k.container, "diff-"+target.Name, target, true)
+}
+
+// diffIn runs Diff in c, against the cluster its kubeconfig points at.
+// Config.DiffIgnoreAnnotations is only applied when dropIgnored is set,
+// since it looks the live objects up in the cluster of the instance.
+func (k *K8sInstance) diffIn(c *dagger.Container, name string, target DiffTarget, dropIgnored bool) (*FluxDiff, error) {
+	targetPath := target.sourcePath()
+	res, err := k.execIn(c, name, "flux "+diffCommand(target, targetPath), true)
+	missing := err != nil && kustomizationMissing(res.Stderr, target.Name)
+	// a custom resource without its CRD is told apart from the Kustomization
+	// itself missing first, so it is never taken for an empty cluster
+	var pending []DiffEntry
+	if err != nil && !missing && k.cfg.TolerateMissingCRDs && strings.Contains(res.Stderr, "no matches for kind") {
+		res, pending, err = k.diffWithoutMissingCRDs(c, name, target)
+	}
+	if missing && k.cfg.GreenfieldDiff {
+		if res, err = k.greenfieldDiff(c, name, targetPath); err != nil {
+			return nil, fmt.Errorf("failed to diff kustomization %s on an empty cluster: %w", target.Name, err)
+		}
+	}
+	// flux diff exits 1 both on drift and on failure, only the former prints
+	// objects to stdout.
+	if err != nil && (res.ExitCode != 1 || !strings.Contains(res.Stdout, diffMarker)) {
+		return nil, fmt.Errorf("failed to diff kustomization %s: %w", target.Name, err)
+	}
+	out := res.Stdout
+
+	if k.cfg.MaskSecrets {
+		out = maskSecretDiffs(out)
+	}
+	d := &FluxDiff{
+		Kustomization: target.Name,
+		Path:          targetPath,
+		Output:        out,
+		ExitCode:      res.ExitCode,
+		CRDPending:    pending,
+	}
+	entries := parseFluxDiff(out)
+	if dropIgnored && len(k.cfg.DiffIgnoreAnnotations) > 0 {
+		if entries, err = k.dropIgnored(entries); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range entries {
+		if e.Action == "deleted" {
+			d.Deletions = append(d.Deletions, e)
+		} else {
+			d.Changes = append(d.Changes, e)
+		}
+	}
+	return d, nil
+}
+
+// diffCommand is the flux diff command of target, diffing the kustomization
+// at targetPath.
+func diffCommand(target DiffTarget, targetPath string) string {
+	command := fmt.Sprintf("diff kustomization %s --path %s", target.Name, targetPath)
+	if target.Namespace != "" {
+		command += " -n " + target.Namespace
+	}
+	return command
+}
+
+// dropIgnored removes the entries whose live object carries one of the
+// Config.DiffIgnoreAnnotations. Objects that do not exist yet are kept.
+func (k *K8sInstance) dropIgnored(entries []DiffEntry) ([]DiffEntry, error) {
+	kept := entries[:0]
+	for _, e := range entries {
+		o, err := k.liveObject(e.ResourceRef)
+		if err != nil {
+			return nil, err
+		}
+		if o != nil && matchesAnnotations(o.Metadata.Annotations, k.cfg.DiffIgnoreAnnotations) {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept, nil
+}
+
+// matchesAnnotations reports whether annotations hold any of the ignore
+// key/value pairs.
+func matchesAnnotations(annotations, ignore map[string]string) bool {
+	for key, value := range ignore {
+		if v, ok := annotations[key]; ok && v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// kustomizationMissing reports whether flux diff failed because the
+// Kustomization name, or the flux Kustomization CRD, is not in the cluster
+// yet. Other objects not found or without a CRD do not qualify.
+func kustomizationMissing(stderr, name string) bool {
+	return strings.Contains(stderr, fmt.Sprintf("%s %q not found", fluxCRD, name)) ||
+		strings.Contains(stderr, `no matches for kind "Kustomization" in version "kustomize.toolkit.fluxcd.io/`)
+}
+
+// greenfieldDiff stands in for flux diff when the kustomization is not in the
+// cluster yet: every object rendered from targetPath is reported as created,
+// in the flux diff output format and without the object content, so Secrets
+// stay masked. It exits 1 on objects to create, like flux diff on drift.
+func (k *K8sInstance) greenfieldDiff(c *dagger.Container, name, targetPath string) (ExecResult, error) {
+	res, err := k.execIn(c, name, "kubectl kustomize "+shellQuote(targetPath), false)
+	if err != nil {
+		return res, fmt.Errorf("failed to render %s: %w", targetPath, err)
+	}
+	var b strings.Builder
+	for _, ref := range parseRenderedObjects(res.Stdout) {
+		fmt.Fprintf(&b, "%s%s created\n", diffMarker, ref)
+	}
+	res = ExecResult{Stdout: b.String()}
+	if b.Len() > 0 {
+		res.ExitCode = 1
+	}
+	return res, nil
+}
+
+// parseRenderedObjects lists the objects of kustomize output, which puts
+// kind at the top level and name and namespace right under metadata.
+func parseRenderedObjects(out string) []ResourceRef {
+	var refs []ResourceRef
+	for _, doc := range strings.Split(out, "\n---\n") {
+		var ref ResourceRef
+		inMetadata := false
+		for _, line := range strings.Split(doc, "\n") {
+			switch {
+			case strings.HasPrefix(line, "kind: "):
+				ref.Kind = strings.TrimSpace(strings.TrimPrefix(line, "kind: "))
+			case line == "metadata:":
+				inMetadata = true
+			case !strings.HasPrefix(line, " "):
+				inMetadata = false
+			case inMetadata && strings.HasPrefix(line, "  name: "):
+				ref.Name = strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "  name: ")), `"'`)
+			case inMetadata && strings.HasPrefix(line, "  namespace: "):
+				ref.Namespace = strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "  namespace: ")), `"'`)
+			}
+		}
+		if ref.Kind != "" && ref.Name != "" {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// diffMarker prefixes every object line in flux diff output.
+const diffMarker = "► "
+
+// parseFluxDiff extracts the objects from flux diff output, which looks like
+//
+//	► Deployment/default/podinfo drifted
+//	<field changes>
+//	► ConfigMap/default/old deleted
+func parseFluxDiff(out string) []DiffEntry {
+	var entries []DiffEntry
+	var detail []string
+	flush := func() {
+		if len(entries) > 0 {
+			entries[len(entries)-1].Detail = strings.TrimSpace(strings.Join(detail, "\n"))
+		}
+		detail = nil
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, diffMarker) {
+			detail = append(detail, line)
+			continue
+		}
+		flush()
+		fields := strings.Fields(strings.TrimPrefix(line, diffMarker))
+		if len(fields) < 2 {
+			continue
+		}
+		entries = append(entries, DiffEntry{
+			ResourceRef: parseResourceRef(fields[0]),
+			Action:      fields[len(fields)-1],
+		})
+	}
+	flush()
+	return entries
+}
+
+// parseResourceRef parses Kind/namespace/name or Kind/name for cluster scoped
+// objects.
+func parseResourceRef(s string) ResourceRef {
+	parts := strings.SplitN(s, "/", 3)
+	switch len(parts) {
+	case 3:
+		return ResourceRef{Kind: parts[0], Namespace: parts[1], Name: parts[2]}
+	case 2:
+		return ResourceRef{Kind: parts[0], Name: parts[1]}
+	default:
+		return ResourceRef{Name: s}
+	}
+}
+
+// maskedSecretData replaces the field changes of a Secret in masked diffs.
+const maskedSecretData = "secret data changed (values masked)"
+
+// maskSecretDiffs replaces the field changes flux printed under each Secret
+// with maskedSecretData, leaving the object line in place so the Secret is
+// still reported.
+func maskSecretDiffs(out string) string {
+	var b strings.Builder
+	inSecret, masked := false, false
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, diffMarker) {
+			ref, _, _ := strings.Cut(strings.TrimPrefix(line, diffMarker), " ")
+			inSecret = parseResourceRef(ref).Kind == "Secret"
+			masked = false
+		} else if inSecret {
+			if !masked && strings.TrimSpace(line) != "" {
+				b.WriteString(maskedSecretData + "\n")
+				masked = true
+			}
+			continue
+		}
+		b.WriteString(line + "\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// maskUnifiedDiff masks the values on the changed lines of a unified diff of
+// a Secret, keeping the keys so the changed entries remain visible.
+func maskUnifiedDiff(diff string) string {
+	lines := strings.Split(diff, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "+++") || strings.HasPrefix(line, "---") {
+			continue
+		}
+		if !strings.HasPrefix(line, "+") && !strings.HasPrefix(line, "-") {
+			continue
+		}
+		if key, _, ok := strings.Cut(line, ":"); ok {
+			lines[i] = key + ": ***"
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func indent(s, prefix string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(s, "\n") {
+		b.WriteString(prefix + line + "\n")
+	}
+	return b.String()
+}
+
+// DiffResourceVerbose diffs a single object between the cluster and the
+// desired state, as a unified diff with contextLines lines of context.
+// The desired version is rendered from the first diff target holding the
+// object and compared through kubectl diff, so server side defaults do not
+// show up as changes. An empty string means the object is in sync.
+func (k *K8sInstance) DiffResourceVerbose(kind, name, namespace string, contextLines int) (string, error) {
+	selector := fmt.Sprintf(
+		`jq -c --arg kind %s --arg name %s --arg ns %s '(if .kind == "List" then .items[] else . end) | select(.kind == $kind and .metadata.name == $name and ((.metadata.namespace // $ns) == $ns))'`,
+		shellQuote(kind), shellQuote(name), shellQuote(namespace),
+	)
+	nsFlag := ""
+	if namespace != "" {
+		nsFlag = "-n " + shellQuote(namespace)
+	}
+	for _, target := range k.diffTargets() {
+		render := fmt.Sprintf(
+			"set -o pipefail; kubectl kustomize %s | kubectl create --dry-run=client -o json -f - | %s",
+			shellQuote(target.sourcePath()), selector,
+		)
+		res, err := k.exec("render-"+name, render, true)
+		if err != nil {
+			return "", fmt.Errorf("failed to render %s/%s/%s from %s: %w", kind, namespace, name, target.Name, err)
+		}
+		object := strings.TrimSpace(res.Stdout)
+		if object == "" {
+			continue
+		}
+		// the desired object is piped in so that the exit code is the one
+		// of kubectl diff
+		diff := fmt.Sprintf(`printf '%%s\n' %s | KUBECTL_EXTERNAL_DIFF="diff -U %d" kubectl diff %s -f -`, shellQuote(object), contextLines, nsFlag)
+		res, err = k.exec("diff-"+name, diff, true)
+		if err != nil {
+			// kubectl diff exits 1 when the object differs
+			if res.ExitCode == 1 {
+				if kind == "Secret" && k.cfg.MaskSecrets {
+					return maskUnifiedDiff(res.Stdout), nil
+				}
+				return res.Stdout, nil
+			}
+			return "", fmt.Errorf("failed to diff %s/%s/%s from %s: %w", kind, namespace, name, target.Name, err)
+		}
+		return res.Stdout, nil
+	}
+	return "", fmt.Errorf("%s/%s/%s is not part of any diff target", kind, namespace, name)
+}
@@ -0,0 +1,260 @@
+package k3sflux
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFluxDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []DiffEntry
+	}{
+		{
+			name: "no objects",
+			out:  "✓ Kustomization diffing...\n✓ no changes\n",
+		},
+		{
+			name: "drift with detail",
+			out:  "► Deployment/default/podinfo drifted\n\nspec.replicas\n  ± value change\n    - 1\n    + 2\n",
+			want: []DiffEntry{{
+				ResourceRef: ResourceRef{Kind: "Deployment", Namespace: "default", Name: "podinfo"},
+				Action:      "drifted",
+				Detail:      "spec.replicas\n  ± value change\n    - 1\n    + 2",
+			}},
+		},
+		{
+			name: "cluster scoped and deleted",
+			out:  "► Namespace/podinfo created\n► ConfigMap/default/old deleted\n",
+			want: []DiffEntry{
+				{ResourceRef: ResourceRef{Kind: "Namespace", Name: "podinfo"}, Action: "created"},
+				{ResourceRef: ResourceRef{Kind: "ConfigMap", Namespace: "default", Name: "old"}, Action: "deleted"},
+			},
+		},
+		{
+			name: "marker without action",
+			out:  "► Deployment/default/podinfo\n► Service/default/podinfo created\n",
+			want: []DiffEntry{
+				{ResourceRef: ResourceRef{Kind: "Service", Namespace: "default", Name: "podinfo"}, Action: "created"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseFluxDiff(tt.out); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseFluxDiff() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaskSecretDiffs(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want string
+	}{
+		{
+			name: "no secrets",
+			out:  "► ConfigMap/default/settings drifted\n  data.level\n    - info\n    + debug",
+			want: "► ConfigMap/default/settings drifted\n  data.level\n    - info\n    + debug",
+		},
+		{
+			name: "secret values",
+			out:  "► Secret/default/creds drifted\n  data.password\n    - aHVudGVyMg==\n    + c2VjcmV0",
+			want: "► Secret/default/creds drifted\n" + maskedSecretData,
+		},
+		{
+			name: "secret between other objects",
+			out:  "► Deployment/default/web drifted\n  spec.replicas\n► Secret/default/creds drifted\n  data.token\n\n► Secret/default/new created\n► ConfigMap/default/old deleted",
+			want: "► Deployment/default/web drifted\n  spec.replicas\n► Secret/default/creds drifted\n" + maskedSecretData + "\n► Secret/default/new created\n► ConfigMap/default/old deleted",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := maskSecretDiffs(tt.out); got != tt.want {
+				t.Errorf("maskSecretDiffs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffTargetSourcePath(t *testing.T) {
+	tests := []struct {
+		name   string
+		target DiffTarget
+		want   string
+	}{
+		{name: "cloned repository", target: DiffTarget{Path: "apps/production"}, want: "/src/apps/production"},
+		{name: "source root in the repository", target: DiffTarget{Path: "production", SourceRoot: "/src/teams/web"}, want: "/src/teams/web/production"},
+		{name: "local manifests", target: DiffTarget{Path: "./apps", SourceRoot: "/local"}, want: "/local/apps"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.target.sourcePath(); got != tt.want {
+				t.Errorf("sourcePath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffTargetSourcePathIn(t *testing.T) {
+	tests := []struct {
+		name   string
+		target DiffTarget
+		want   string
+	}{
+		{name: "cloned repository", target: DiffTarget{Path: "apps/production"}, want: "/tmp/applied/apps/production"},
+		{name: "source root in the repository", target: DiffTarget{Path: "production", SourceRoot: "/src/teams/web"}, want: "/tmp/applied/teams/web/production"},
+		{name: "source root mount itself", target: DiffTarget{Path: "apps", SourceRoot: "/src"}, want: "/tmp/applied/apps"},
+		{name: "prefix of another directory", target: DiffTarget{Path: "apps", SourceRoot: "/srcs"}, want: "/tmp/applied/apps"},
+		{name: "local manifests", target: DiffTarget{Path: "./apps", SourceRoot: "/local"}, want: "/tmp/applied/apps"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.target.sourcePathIn("/tmp/applied"); got != tt.want {
+				t.Errorf("sourcePathIn() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffIgnoreAnnotations(t *testing.T) {
+	k := NewOfflineInstance(context.Background(), Config{DiffIgnoreAnnotations: map[string]string{"example.com/drift": "expected"}}, RecordedExecutor{
+		"flux diff kustomization apps --path /src/apps": {
+			Stdout:   "► Deployment/default/web drifted\n► Deployment/default/api drifted\n► ConfigMap/default/new created\n",
+			ExitCode: 1,
+		},
+		"kubectl get Deployment/web --ignore-not-found -n default -o json": {Stdout: `{"kind": "Deployment", "metadata": {"name": "web", "annotations": {"example.com/drift": "expected"}}}`},
+		"kubectl get Deployment/api --ignore-not-found -n default -o json": {Stdout: `{"kind": "Deployment", "metadata": {"name": "api", "annotations": {"example.com/drift": "unexpected"}}}`},
+		"kubectl get ConfigMap/new --ignore-not-found -n default -o json":  {},
+	})
+	d, err := k.Diff(DiffTarget{Name: "apps", Path: "apps"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DiffEntry{
+		{ResourceRef: ResourceRef{Kind: "Deployment", Namespace: "default", Name: "api"}, Action: "drifted"},
+		{ResourceRef: ResourceRef{Kind: "ConfigMap", Namespace: "default", Name: "new"}, Action: "created"},
+	}
+	if !reflect.DeepEqual(d.Changes, want) {
+		t.Errorf("changes = %+v, want %+v", d.Changes, want)
+	}
+}
+
+func TestKustomizationMissing(t *testing.T) {
+	tests := []struct {
+		name   string
+		stderr string
+		want   bool
+	}{
+		{name: "kustomization not found", stderr: `✗ kustomizations.kustomize.toolkit.fluxcd.io "apps" not found`, want: true},
+		{name: "flux CRD missing", stderr: `✗ no matches for kind "Kustomization" in version "kustomize.toolkit.fluxcd.io/v1"`, want: true},
+		{name: "other kustomization", stderr: `✗ kustomizations.kustomize.toolkit.fluxcd.io "infra" not found`},
+		{name: "other object not found", stderr: `✗ secrets "apps" not found`},
+		{name: "other CRD missing", stderr: `✗ no matches for kind "ServiceMonitor" in version "monitoring.coreos.com/v1"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := kustomizationMissing(tt.stderr, "apps"); got != tt.want {
+				t.Errorf("kustomizationMissing() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRenderedObjects(t *testing.T) {
+	out := `apiVersion: v1
+kind: Namespace
+metadata:
+  labels:
+    name: web
+  name: web
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: "web"
+  namespace: 'web'
+spec:
+  template:
+    metadata:
+      name: ignored
+---
+apiVersion: v1
+kind: ConfigMap
+data:
+  name: not-metadata
+`
+	want := []ResourceRef{
+		{Kind: "Namespace", Name: "web"},
+		{Kind: "Deployment", Namespace: "web", Name: "web"},
+	}
+	if got := parseRenderedObjects(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseRenderedObjects() = %+v, want %+v", got, want)
+	}
+}
+
+func TestDiffResourceVerbose(t *testing.T) {
+	const object = `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"default"}}`
+	targets := []DiffTarget{{Name: "infra", Path: "infra"}, {Name: "apps", Path: "apps"}}
+	drift := ExecResult{Stdout: "--- /tmp/LIVE/apps.v1.Deployment.default.web\n+++ /tmp/MERGED/apps.v1.Deployment.default.web\n-  replicas: 1\n+  replicas: 2\n", ExitCode: 1}
+	tests := []struct {
+		name    string
+		steps   []*scriptedStep
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "in sync",
+			steps: []*scriptedStep{step("'/src/infra' |"), step("'/src/apps' |", ExecResult{Stdout: object + "\n"}), step("kubectl diff")},
+		},
+		{
+			name:  "drift",
+			steps: []*scriptedStep{step("'/src/infra' |"), step("'/src/apps' |", ExecResult{Stdout: object + "\n"}), step("kubectl diff", drift)},
+			want:  drift.Stdout,
+		},
+		{
+			name:    "failed render is not drift",
+			steps:   []*scriptedStep{step("'/src/infra' |", ExecResult{Stderr: "error: accumulating resources", ExitCode: 1})},
+			wantErr: "failed to render Deployment/default/web from infra",
+		},
+		{
+			name:    "failed diff",
+			steps:   []*scriptedStep{step("'/src/infra' |", ExecResult{Stdout: object + "\n"}), step("kubectl diff", ExecResult{Stderr: "error: connection refused", ExitCode: 2})},
+			wantErr: "failed to diff Deployment/default/web from infra",
+		},
+		{
+			name:    "not rendered",
+			steps:   []*scriptedStep{step("kubectl kustomize")},
+			wantErr: "Deployment/default/web is not part of any diff target",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := script(tt.steps...)
+			k := NewOfflineInstance(context.Background(), Config{DiffTargets: targets}, e)
+			got, err := k.DiffResourceVerbose("Deployment", "web", "default", 3)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("DiffResourceVerbose() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("DiffResourceVerbose() = %q, want %q", got, tt.want)
+			}
+			for _, command := range e.commands {
+				if strings.Contains(command, "kubectl diff") && !strings.HasPrefix(command, "printf '%s\\n' '"+object+"' |") {
+					t.Errorf("kubectl diff does not read the rendered object: %q", command)
+				}
+			}
+		})
+	}
+}
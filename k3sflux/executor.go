@@ -0,0 +1,107 @@
+package k3sflux
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// Executor runs the commands of the helpers, each a sh -c script such as
+// "kubectl get pods -A -o json". c is the tools container the command runs
+// in and name the pipeline it is logged under; cacheBust asks for the
+// command to run afresh rather than from cache. A command exiting non-zero
+// returns its output in the result next to an error carrying it, a
+// *dagger.ExecError or a *CommandError.
+type Executor interface {
+	Exec(ctx context.Context, c *dagger.Container, name, command string, cacheBust bool) (ExecResult, error)
+}
+
+// DaggerExecutor runs the commands in the Dagger tools container, the
+// Executor of every instance unless WithExecutor replaces it.
+type DaggerExecutor struct{}
+
+func (DaggerExecutor) Exec(ctx context.Context, c *dagger.Container, name, command string, cacheBust bool) (ExecResult, error) {
+	if cacheBust {
+		c = c.WithEnvVariable("CACHE", time.Now().String())
+	}
+	executed := c.Pipeline(name).Pipeline(command).
+		WithExec([]string{command})
+	var res ExecResult
+	stdout, err := executed.Stdout(ctx)
+	if err == nil {
+		res.Stdout = stdout
+		// the exec already ran, reading its stderr does not run it again
+		res.Stderr, err = executed.Stderr(ctx)
+	} else if failed, ok := execFailure(err); ok {
+		res = failed
+	}
+	return res, err
+}
+
+// CommandError reports a command that exited non-zero, for executors other
+// than DaggerExecutor.
+type CommandError struct {
+	Command string
+	ExecResult
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%s exited with %d: %s", e.Command, e.ExitCode, e.Stderr)
+}
+
+// RecordedExecutor answers every command with a recorded result instead of
+// running it, keyed by the exact command, e.g.
+// "kubectl get kustomizations.kustomize.toolkit.fluxcd.io -A -o json". A
+// result with a non-zero ExitCode is returned with a *CommandError; a
+// command that was not recorded fails.
+type RecordedExecutor map[string]ExecResult
+
+func (r RecordedExecutor) Exec(_ context.Context, _ *dagger.Container, _, command string, _ bool) (ExecResult, error) {
+	res, ok := r[command]
+	if !ok {
+		return ExecResult{}, fmt.Errorf("no recorded result for %q", command)
+	}
+	if res.ExitCode != 0 {
+		return res, &CommandError{Command: command, ExecResult: res}
+	}
+	return res, nil
+}
+
+// WithExecutor replaces the Executor running the commands of the instance,
+// e.g. with a RecordedExecutor for tests that need no cluster.
+func (k *K8sInstance) WithExecutor(e Executor) *K8sInstance {
+	k.executor = e
+	return k
+}
+
+// NewOfflineInstance returns an instance without a Dagger session whose
+// commands all go to e, for exercising the diff, status and parsing helpers
+// against recorded output. Only the helpers that run plain commands work;
+// start and the ones handing files to or reading them from the engine, such
+// as Apply, PrePullImages or ExportKubeconfig, return an error and need
+// NewK8sInstance.
+func NewOfflineInstance(ctx context.Context, cfg Config, e Executor) *K8sInstance {
+	cfg.Bootstrap = cfg.Bootstrap.withDefaults()
+	return &K8sInstance{ctx: ctx, cfg: cfg, executor: e}
+}
+
+// requireSession returns an error for helpers that need a Dagger session
+// when called on an offline instance.
+func (k *K8sInstance) requireSession(what string) error {
+	if k.client == nil {
+		return fmt.Errorf("%s needs a Dagger session, the instance is offline", what)
+	}
+	return nil
+}
+
+// sessionContainer returns the container build assembles, or nil on an
+// instance of NewOfflineInstance, whose Executor runs the commands without
+// one.
+func (k *K8sInstance) sessionContainer(build func() *dagger.Container) *dagger.Container {
+	if k.client == nil {
+		return nil
+	}
+	return build()
+}
@@ -0,0 +1,307 @@
+package k3sflux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"dagger.io/dagger"
+)
+
+const (
+	fluxCRDLookup     = "kubectl get crd " + fluxCRD + " --ignore-not-found -o name"
+	fluxCRDFound      = "customresourcedefinition.apiextensions.k8s.io/" + fluxCRD + "\n"
+	appsDiffCommand   = "flux diff kustomization apps --path /src/apps"
+	kustomizationList = "kubectl get kustomizations.kustomize.toolkit.fluxcd.io -A -o json"
+)
+
+func offline(cfg Config, recorded RecordedExecutor) *K8sInstance {
+	return NewOfflineInstance(context.Background(), cfg, recorded)
+}
+
+// scriptedExecutor answers each command with the next result of the first
+// step whose match it contains, repeating the last one, for commands that
+// answer differently from one call to the next. It records the commands it
+// ran.
+type scriptedExecutor struct {
+	steps    []*scriptedStep
+	commands []string
+}
+
+type scriptedStep struct {
+	match   string
+	results []ExecResult
+	calls   int
+}
+
+func script(steps ...*scriptedStep) *scriptedExecutor {
+	return &scriptedExecutor{steps: steps}
+}
+
+func step(match string, results ...ExecResult) *scriptedStep {
+	if len(results) == 0 {
+		results = []ExecResult{{}}
+	}
+	return &scriptedStep{match: match, results: results}
+}
+
+func (e *scriptedExecutor) Exec(_ context.Context, _ *dagger.Container, _, command string, _ bool) (ExecResult, error) {
+	e.commands = append(e.commands, command)
+	for _, s := range e.steps {
+		if !strings.Contains(command, s.match) {
+			continue
+		}
+		res := s.results[len(s.results)-1]
+		if s.calls < len(s.results) {
+			res = s.results[s.calls]
+		}
+		s.calls++
+		if res.ExitCode != 0 {
+			return res, &CommandError{Command: command, ExecResult: res}
+		}
+		return res, nil
+	}
+	return ExecResult{}, fmt.Errorf("no scripted result for %q", command)
+}
+
+// count is how many of the commands ran contain match.
+func (e *scriptedExecutor) count(match string) int {
+	n := 0
+	for _, command := range e.commands {
+		if strings.Contains(command, match) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRecordedExecutor(t *testing.T) {
+	e := RecordedExecutor{
+		"kubectl version": {Stdout: "v1.27.3\n"},
+		"kubectl fail":    {Stderr: "boom", ExitCode: 2},
+	}
+	res, err := e.Exec(context.Background(), nil, "kubectl", "kubectl version", false)
+	if err != nil || res.Stdout != "v1.27.3\n" {
+		t.Fatalf("recorded command = %+v, %v", res, err)
+	}
+	res, err = e.Exec(context.Background(), nil, "kubectl", "kubectl fail", false)
+	var failed *CommandError
+	if !errors.As(err, &failed) || failed.ExitCode != 2 || res.Stderr != "boom" {
+		t.Fatalf("failing command = %+v, %v", res, err)
+	}
+	if got, ok := execFailure(err); !ok || got.ExitCode != 2 {
+		t.Fatalf("execFailure = %+v, %v", got, ok)
+	}
+	if _, err := e.Exec(context.Background(), nil, "kubectl", "kubectl get pods", false); err == nil {
+		t.Fatal("unrecorded command succeeded")
+	}
+}
+
+func TestOfflineDiff(t *testing.T) {
+	notFound := ExecResult{Stderr: `✗ ` + fluxCRD + ` "apps" not found`, ExitCode: 1}
+	tests := []struct {
+		name      string
+		cfg       Config
+		recorded  RecordedExecutor
+		changes   []DiffEntry
+		deletions []DiffEntry
+		wantErr   bool
+	}{
+		{
+			name:     "in sync",
+			recorded: RecordedExecutor{appsDiffCommand: {Stdout: "✓ Kustomization diffing...\n"}},
+		},
+		{
+			name: "drift and prune",
+			recorded: RecordedExecutor{appsDiffCommand: {
+				Stdout:   "► Deployment/default/web drifted\n  spec.replicas\n    ± value change\n      - 1\n      + 2\n► ConfigMap/default/old deleted\n",
+				ExitCode: 1,
+			}},
+			changes: []DiffEntry{{
+				ResourceRef: ResourceRef{Kind: "Deployment", Namespace: "default", Name: "web"},
+				Action:      "drifted",
+				Detail:      "spec.replicas\n    ± value change\n      - 1\n      + 2",
+			}},
+			deletions: []DiffEntry{{
+				ResourceRef: ResourceRef{Kind: "ConfigMap", Namespace: "default", Name: "old"},
+				Action:      "deleted",
+			}},
+		},
+		{
+			name: "masked secret",
+			cfg:  Config{MaskSecrets: true},
+			recorded: RecordedExecutor{appsDiffCommand: {
+				Stdout:   "► Secret/default/creds drifted\n  data.password\n    - aHVudGVyMg==\n    + c2VjcmV0\n",
+				ExitCode: 1,
+			}},
+			changes: []DiffEntry{{
+				ResourceRef: ResourceRef{Kind: "Secret", Namespace: "default", Name: "creds"},
+				Action:      "drifted",
+				Detail:      maskedSecretData,
+			}},
+		},
+		{
+			name:     "greenfield",
+			cfg:      Config{GreenfieldDiff: true},
+			recorded: RecordedExecutor{appsDiffCommand: notFound, "kubectl kustomize '/src/apps'": {Stdout: "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: web\n"}},
+			changes: []DiffEntry{{
+				ResourceRef: ResourceRef{Kind: "Namespace", Name: "web"},
+				Action:      "created",
+			}},
+		},
+		{
+			name:     "missing kustomization",
+			recorded: RecordedExecutor{appsDiffCommand: notFound},
+			wantErr:  true,
+		},
+		{
+			name:     "flux failure",
+			recorded: RecordedExecutor{appsDiffCommand: {Stderr: "✗ connection refused", ExitCode: 1}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := offline(tt.cfg, tt.recorded).Diff(DiffTarget{Name: "apps", Path: "apps"})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Diff succeeded: %+v", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(d.Changes, tt.changes) {
+				t.Errorf("changes = %+v, want %+v", d.Changes, tt.changes)
+			}
+			if !reflect.DeepEqual(d.Deletions, tt.deletions) {
+				t.Errorf("deletions = %+v, want %+v", d.Deletions, tt.deletions)
+			}
+		})
+	}
+}
+
+func TestOfflineAppliedResources(t *testing.T) {
+	k := offline(Config{}, RecordedExecutor{
+		fluxCRDLookup: {Stdout: fluxCRDFound},
+		kustomizationList: {Stdout: `{"items": [
+			{"metadata": {"name": "apps", "namespace": "flux-system"}, "status": {"inventory": {"entries": [
+				{"id": "default_web_apps_Deployment", "v": "v1"},
+				{"id": "_web__Namespace", "v": "v1"}
+			]}}},
+			{"metadata": {"name": "infra", "namespace": "flux-system"}}
+		]}`},
+	})
+	applied, err := k.AppliedResources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]ResourceRef{
+		"flux-system/apps": {
+			{Group: "apps", Kind: "Deployment", Namespace: "default", Name: "web"},
+			{Kind: "Namespace", Name: "web"},
+		},
+		"flux-system/infra": {},
+	}
+	if !reflect.DeepEqual(applied, want) {
+		t.Errorf("AppliedResources() = %+v, want %+v", applied, want)
+	}
+}
+
+func TestOfflineFluxNotInstalled(t *testing.T) {
+	k := offline(Config{}, RecordedExecutor{fluxCRDLookup: {}})
+	if _, err := k.AppliedResources(); !errors.Is(err, ErrFluxNotInstalled) {
+		t.Errorf("AppliedResources() error = %v, want ErrFluxNotInstalled", err)
+	}
+	if bootstrapped, err := k.IsBootstrapped(); bootstrapped || err != nil {
+		t.Errorf("IsBootstrapped() = %v, %v", bootstrapped, err)
+	}
+}
+
+func TestOfflineWaitForHelmReleases(t *testing.T) {
+	list := "kubectl get helmreleases.helm.toolkit.fluxcd.io -n apps -o json"
+	tests := []struct {
+		name    string
+		items   string
+		wantErr string
+	}{
+		{
+			name:  "ready",
+			items: `{"metadata": {"name": "web", "namespace": "apps"}, "status": {"conditions": [{"type": "Ready", "status": "True"}]}}`,
+		},
+		{
+			name:    "not ready",
+			items:   `{"metadata": {"name": "web", "namespace": "apps"}, "status": {"conditions": [{"type": "Ready", "status": "False", "reason": "InstallFailed", "message": "timed out"}]}}`,
+			wantErr: "apps/web (InstallFailed: timed out)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := offline(Config{}, RecordedExecutor{
+				fluxCRDLookup: {Stdout: fluxCRDFound},
+				list:          {Stdout: `{"items": [` + tt.items + `]}`},
+			})
+			err := k.waitForHelmReleases("apps", 0)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("waitForHelmReleases() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOfflineCleanup(t *testing.T) {
+	k := offline(Config{}, RecordedExecutor{"find /cache/k3s -mindepth 1 -delete": {}})
+	if err := k.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOfflineSessionHelpers(t *testing.T) {
+	k := offline(Config{}, RecordedExecutor{})
+	helpers := map[string]func() error{
+		"Apply": func() error {
+			_, err := k.Apply(nil)
+			return err
+		},
+		"PrePullImages": func() error {
+			_, err := k.PrePullImages([]string{"nginx"})
+			return err
+		},
+		"ExportKubeconfig": func() error { return k.ExportKubeconfig("kubeconfig") },
+		"collectDiagnostics": func() error {
+			_, err := k.collectDiagnostics()
+			return err
+		},
+		"profileKustomization": func() error {
+			_, err := k.profileKustomization(FluxResourceMinimal)
+			return err
+		},
+		"joinToken": func() error {
+			_, err := k.joinToken()
+			return err
+		},
+		"WithSSHAuth": func() error {
+			return offline(Config{}, RecordedExecutor{}).WithSSHAuth("id_ed25519", "").err
+		},
+		"RenderBootstrapManifests": func() error {
+			_, err := k.RenderBootstrapManifests(Config{Bootstrap: BootstrapConfig{Path: "clusters/ci"}})
+			return err
+		},
+		"start": k.start,
+	}
+	for name, helper := range helpers {
+		if err := helper(); err == nil || !strings.Contains(err.Error(), "offline") {
+			t.Errorf("%s error = %v, want the offline error", name, err)
+		}
+	}
+}
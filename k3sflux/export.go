@@ -0,0 +1,58 @@
+package k3sflux
+
+import (
+	"fmt"
+	"strings"
+)
+
+// fluxExportKinds are the flux objects ExportFluxConfig captures, as the
+// flux export subcommand and the CRD behind it.
+var fluxExportKinds = []struct {
+	command string
+	crd     string
+}{
+	{"source git", "gitrepositories.source.toolkit.fluxcd.io"},
+	{"source helm", "helmrepositories.source.toolkit.fluxcd.io"},
+	{"source oci", "ocirepositories.source.toolkit.fluxcd.io"},
+	{"source bucket", "buckets.source.toolkit.fluxcd.io"},
+	{"kustomization", "kustomizations.kustomize.toolkit.fluxcd.io"},
+	{"helmrelease", "helmreleases.helm.toolkit.fluxcd.io"},
+}
+
+// ExportFluxConfig exports the live flux sources, Kustomizations and
+// HelmReleases of every namespace as one YAML stream, ready to commit to a
+// new repository. Kinds whose CRD is not installed, such as helmreleases
+// without the helm-controller, are skipped.
+func (k *K8sInstance) ExportFluxConfig() (string, error) {
+	if err := k.requireFlux(); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, kind := range fluxExportKinds {
+		res, err := k.kubectl(fmt.Sprintf("get crd %s --ignore-not-found -o name", kind.crd), true)
+		if err != nil {
+			return "", fmt.Errorf("failed to look up %s: %w", kind.crd, err)
+		}
+		if strings.TrimSpace(res.Stdout) == "" {
+			continue
+		}
+		res, err = k.kubectl(fmt.Sprintf("get %s -A -o jsonpath='{.items[*].metadata.namespace}'", kind.crd), true)
+		if err != nil {
+			return "", fmt.Errorf("failed to list %s: %w", kind.crd, err)
+		}
+		// flux export --all only covers one namespace
+		namespaces := map[string]bool{}
+		for _, ns := range strings.Fields(res.Stdout) {
+			namespaces[ns] = true
+		}
+		for _, ns := range sortedKeys(namespaces) {
+			res, err := k.flux(fmt.Sprintf("export %s --all -n %s", kind.command, ns), true)
+			if err != nil {
+				return "", fmt.Errorf("failed to export %s in %s: %w", kind.command, ns, err)
+			}
+			// every exported object starts with its own --- separator
+			b.WriteString(res.Stdout)
+		}
+	}
+	return b.String(), nil
+}
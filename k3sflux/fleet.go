@@ -0,0 +1,90 @@
+package k3sflux
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// fleetConcurrency bounds how many clusters DiffFleet diffs at once.
+const fleetConcurrency = 4
+
+// DiffFleet diffs target against several live clusters, keyed by cluster
+// name with a kubeconfig each, to see which clusters a change would touch
+// before it is rolled out. The diffs run in the tools container with the
+// repository mounted but without the k3s cluster, so the instance does not
+// need to be started. The diffs that succeeded are returned per cluster
+// next to an error joining the failed ones; Config.DiffIgnoreAnnotations
+// does not apply.
+func (k *K8sInstance) DiffFleet(kubeconfigs map[string]*dagger.Secret, target DiffTarget) (map[string]FluxDiff, error) {
+	if k.err != nil {
+		return nil, k.err
+	}
+	if err := k.requireSession("DiffFleet"); err != nil {
+		return nil, err
+	}
+	src, err := k.diffSource()
+	if err != nil {
+		return nil, err
+	}
+	base := k.toolsContainer().
+		WithSecretVariable("GITHUB_TOKEN", k.client.SetSecret("github-token", k.token())).
+		With(k.withGitAuth).
+		WithDirectory(srcDir, src).
+		With(k.localManifestsMount).
+		WithMountedTemp(k.workDir()).
+		WithWorkdir(k.workDir()).
+		WithEntrypoint([]string{"sh", "-c"})
+
+	var mu sync.Mutex
+	diffs := map[string]FluxDiff{}
+	errs := map[string]error{}
+	sem := make(chan struct{}, fleetConcurrency)
+	var wg sync.WaitGroup
+	for cluster, kubeconfig := range kubeconfigs {
+		wg.Add(1)
+		go func(cluster string, kubeconfig *dagger.Secret) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			p := "/fleet/" + cluster + "/kubeconfig"
+			c := base.WithMountedSecret(p, kubeconfig).WithEnvVariable("KUBECONFIG", p)
+			d, err := k.diffIn(c, "diff-"+target.Name+"-"+cluster, target, false)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[cluster] = fmt.Errorf("cluster %s: %w", cluster, err)
+				return
+			}
+			diffs[cluster] = *d
+		}(cluster, kubeconfig)
+	}
+	wg.Wait()
+
+	joined := make([]error, 0, len(errs))
+	for _, cluster := range sortedKeys(errs) {
+		joined = append(joined, errs[cluster])
+	}
+	if err := errors.Join(joined...); err != nil {
+		return diffs, fmt.Errorf("failed to diff %d of %d cluster(s): %w", len(errs), len(kubeconfigs), err)
+	}
+	return diffs, nil
+}
+
+// FleetReport summarizes a DiffFleet result, one line per cluster in name
+// order with the changes the target would make there.
+func FleetReport(diffs map[string]FluxDiff) string {
+	var b strings.Builder
+	for _, cluster := range sortedKeys(diffs) {
+		d := diffs[cluster]
+		status := "no changes"
+		if d.DriftDetected() {
+			status = fmt.Sprintf("%d change(s), %d deletion(s)", len(d.Changes), len(d.Deletions))
+		}
+		fmt.Fprintf(&b, "%s: %s\n", cluster, status)
+	}
+	return b.String()
+}
@@ -0,0 +1,86 @@
+package k3sflux
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrFluxNotInstalled is returned by the flux querying helpers when the
+// cluster has no flux CRDs, typically because it was not bootstrapped yet.
+var ErrFluxNotInstalled = errors.New("flux is not installed in the cluster")
+
+// fluxCRD is checked to tell whether flux is installed.
+const fluxCRD = "kustomizations.kustomize.toolkit.fluxcd.io"
+
+// fluxInstalled reports whether the flux CRDs exist. A positive answer is
+// remembered until a ClusterPool reset uninstalls flux.
+func (k *K8sInstance) fluxInstalled() (bool, error) {
+	if k.fluxFound {
+		return true, nil
+	}
+	res, err := k.kubectl("get crd "+fluxCRD+" --ignore-not-found -o name", true)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up flux CRDs: %w", err)
+	}
+	k.fluxFound = strings.TrimSpace(res.Stdout) != ""
+	return k.fluxFound, nil
+}
+
+// requireFlux returns ErrFluxNotInstalled when the flux CRDs are missing.
+func (k *K8sInstance) requireFlux() error {
+	installed, err := k.fluxInstalled()
+	if err != nil {
+		return err
+	}
+	if !installed {
+		return ErrFluxNotInstalled
+	}
+	return nil
+}
+
+// AssertFluxComponents checks that the Deployments in flux-system are
+// exactly the expected flux controllers, e.g. source-controller and
+// kustomize-controller, catching a bootstrap with the wrong --components or
+// --components-extra. Both the missing and the unexpected ones are listed in
+// the error.
+func (k *K8sInstance) AssertFluxComponents(expected []string) error {
+	if err := k.requireFlux(); err != nil {
+		return err
+	}
+	var list struct {
+		Items []object `json:"items"`
+	}
+	if err := k.kubectlJSON("get deployments -n flux-system", &list); err != nil {
+		return fmt.Errorf("failed to list flux deployments: %w", err)
+	}
+	running := map[string]bool{}
+	for _, d := range list.Items {
+		running[d.Metadata.Name] = true
+	}
+	want := map[string]bool{}
+	var missing []string
+	for _, name := range expected {
+		want[name] = true
+		if !running[name] {
+			missing = append(missing, name)
+		}
+	}
+	var extra []string
+	for _, name := range sortedKeys(running) {
+		if !want[name] {
+			extra = append(extra, name)
+		}
+	}
+	if len(missing) == 0 && len(extra) == 0 {
+		return nil
+	}
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "missing "+strings.Join(missing, ", "))
+	}
+	if len(extra) > 0 {
+		problems = append(problems, "unexpected "+strings.Join(extra, ", "))
+	}
+	return fmt.Errorf("flux components do not match: %s", strings.Join(problems, "; "))
+}
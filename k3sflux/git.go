@@ -0,0 +1,93 @@
+package k3sflux
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// WithGitTokenFile reads the GitHub token from a file, for CI systems
+// mounting secrets as files. A token file takes precedence over
+// Config.GitToken. It must be called before start; a missing or empty file
+// is reported by start.
+func (k *K8sInstance) WithGitTokenFile(path string) *K8sInstance {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		k.setErr(fmt.Errorf("failed to read git token file: %w", err))
+		return k
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		k.setErr(fmt.Errorf("git token file %s is empty", path))
+		return k
+	}
+	k.gitToken = token
+	return k
+}
+
+// token returns the GitHub token, from WithGitTokenFile or Config.GitToken.
+func (k *K8sInstance) token() string {
+	if k.gitToken != "" {
+		return k.gitToken
+	}
+	return k.cfg.GitToken
+}
+
+// diffSource is the tree of the repository holding the changes to diff,
+// mounted at srcDir.
+func (k *K8sInstance) diffSource() (*dagger.Directory, error) {
+	if k.cfg.BootstrapAuth == BootstrapAuthSSH {
+		return k.sshDiffSource()
+	}
+	gitUrl := k.cfg.Bootstrap.cloneURL(k.token())
+	gitBranch, err := k.gitBranch(k.client.Git(gitUrl), k.cfg.Bootstrap.GitRef)
+	if err != nil {
+		return nil, err
+	}
+	return gitBranch.Tree(), nil
+}
+
+// gitBranch resolves the branch to clone for the diff source, applying
+// Config.OnMissingRef when it does not exist in the repository.
+func (k *K8sInstance) gitBranch(repo *dagger.GitRepository, ref string) (*dagger.GitRef, error) {
+	branches, err := repo.Branches(k.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repository branches: %w", err)
+	}
+	for i, b := range branches {
+		branches[i] = strings.TrimPrefix(b, "refs/heads/")
+	}
+	branch, err := k.pickBranch(branches, ref)
+	if err != nil {
+		return nil, err
+	}
+	return repo.Branch(branch), nil
+}
+
+// pickBranch returns ref when it is among branches, or applies
+// Config.OnMissingRef, whose fallback branch must be among them too.
+func (k *K8sInstance) pickBranch(branches []string, ref string) (string, error) {
+	if containsString(branches, ref) {
+		return ref, nil
+	}
+	fallback := k.cfg.Bootstrap.Branch
+	if k.cfg.OnMissingRef == MissingRefFallbackDefault && containsString(branches, fallback) {
+		k.warnf("branch %s does not exist, falling back to %s", ref, fallback)
+		return fallback, nil
+	}
+	if k.cfg.OnMissingRef == MissingRefFallbackDefault {
+		return "", fmt.Errorf("neither branch %s nor the fallback %s exist in the repository, available branches: %s", ref, fallback, strings.Join(branches, ", "))
+	}
+	return "", fmt.Errorf("branch %s does not exist in the repository, available branches: %s", ref, strings.Join(branches, ", "))
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
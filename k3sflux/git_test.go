@@ -0,0 +1,70 @@
+package k3sflux
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPickBranch(t *testing.T) {
+	branches := []string{"main", "feature/login"}
+	tests := []struct {
+		name    string
+		ref     string
+		policy  MissingRefPolicy
+		branch  string
+		want    string
+		wantErr string
+	}{
+		{name: "existing", ref: "feature/login", want: "feature/login"},
+		{
+			name:    "missing",
+			ref:     "feature/typo",
+			wantErr: "branch feature/typo does not exist in the repository, available branches: main, feature/login",
+		},
+		{name: "missing with fallback", ref: "feature/typo", policy: MissingRefFallbackDefault, want: "main"},
+		{
+			name:    "missing fallback",
+			ref:     "feature/typo",
+			policy:  MissingRefFallbackDefault,
+			branch:  "master",
+			wantErr: "neither branch feature/typo nor the fallback master exist in the repository, available branches: main, feature/login",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := NewOfflineInstance(context.Background(), Config{OnMissingRef: tt.policy, Bootstrap: BootstrapConfig{Branch: tt.branch}}, RecordedExecutor{})
+			got, err := k.pickBranch(branches, tt.ref)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("pickBranch() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("pickBranch() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBootstrapConfigGitRef(t *testing.T) {
+	tests := []struct {
+		name      string
+		bootstrap BootstrapConfig
+		want      string
+	}{
+		{name: "default branch", want: "main"},
+		{name: "bootstrap branch", bootstrap: BootstrapConfig{Branch: "staging"}, want: "staging"},
+		{name: "pull request branch", bootstrap: BootstrapConfig{Branch: "staging", GitRef: "feature/login"}, want: "feature/login"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.bootstrap.withDefaults().GitRef; got != tt.want {
+				t.Errorf("GitRef = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
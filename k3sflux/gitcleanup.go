@@ -0,0 +1,91 @@
+package k3sflux
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// bootstrapAuthor is the author flux bootstrap commits its manifests with,
+// the default of its --author-name flag.
+const bootstrapAuthor = "Flux"
+
+// cleanupAuthors are the commit authors CleanupGitCommits may drop commits
+// of: flux bootstrap, the image automation and Config.CleanupGitAuthors.
+func (k *K8sInstance) cleanupAuthors() map[string]bool {
+	allowed := map[string]bool{bootstrapAuthor: true}
+	automation, err := k.imageAutomationAuthors()
+	if err != nil {
+		// image automation is optional, its CRDs may not be installed
+		automation = []string{imageAutomationAuthor}
+	}
+	for _, author := range append(automation, k.cfg.CleanupGitAuthors...) {
+		allowed[author] = true
+	}
+	return allowed
+}
+
+// recordGitHead remembers the commit the bootstrap branch points to before
+// the run, for CleanupGitCommits to restore.
+func (k *K8sInstance) recordGitHead() (string, error) {
+	branch := k.cfg.Bootstrap.Branch
+	res, err := k.git(fmt.Sprintf("ls-remote %s refs/heads/%s", k.repoShellURL(), branch), true)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the head of %s: %w", branch, err)
+	}
+	fields := strings.Fields(res.Stdout)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("branch %s does not exist in the repository", branch)
+	}
+	k.preRunHead = fields[0]
+	return k.preRunHead, nil
+}
+
+// CleanupGitCommits force-pushes the bootstrap branch back to the commit
+// recordGitHead saw, dropping the commits flux bootstrap and the image
+// automation tests pushed. It refuses to when the branch no longer descends
+// from that commit or when any commit on top of it was authored by someone
+// else than cleanupAuthors, and the push is leased on the head it
+// inspected, so a commit pushed concurrently is never lost.
+func (k *K8sInstance) CleanupGitCommits() (string, error) {
+	branch := k.cfg.Bootstrap.Branch
+	if k.preRunHead == "" {
+		return "", fmt.Errorf("the head of %s was not recorded before the run", branch)
+	}
+	// every exec starts from the tools container again, so both commands
+	// clone the branch
+	dir := shellQuote(path.Join(k.workDir(), "cleanup"))
+	clone := fmt.Sprintf("rm -rf %s && git clone -q --branch %s --single-branch %s %s && cd %s", dir, branch, k.repoShellURL(), dir, dir)
+	command := strings.Join([]string{
+		clone,
+		"git rev-parse HEAD",
+		fmt.Sprintf("git merge-base --is-ancestor %s HEAD", k.preRunHead),
+		fmt.Sprintf("git log --format=%%an %s..HEAD", k.preRunHead),
+	}, " && ")
+	res, err := k.exec("cleanup git", command, true)
+	if err != nil {
+		if res.ExitCode == 1 {
+			return "", fmt.Errorf("branch %s was rewritten during the run, not cleaning it up", branch)
+		}
+		return "", fmt.Errorf("failed to inspect %s: %w", branch, err)
+	}
+	lines := strings.Split(strings.TrimSpace(res.Stdout), "\n")
+	head, authors := lines[0], lines[1:]
+	if head == k.preRunHead {
+		return "no commits to clean up", nil
+	}
+	allowed := k.cleanupAuthors()
+	for _, author := range authors {
+		if !allowed[author] {
+			return "", fmt.Errorf("branch %s has a commit by %s on top of %s, not cleaning it up", branch, author, k.preRunHead)
+		}
+	}
+	_, err = k.exec("cleanup git", fmt.Sprintf(
+		"%s && git push -q --force-with-lease=refs/heads/%s:%s origin %s:refs/heads/%s",
+		clone, branch, head, k.preRunHead, branch,
+	), true)
+	if err != nil {
+		return "", fmt.Errorf("failed to reset %s to %s: %w", branch, k.preRunHead, err)
+	}
+	return fmt.Sprintf("reset %s from %s to %s, dropping %d commit(s)", branch, head, k.preRunHead, len(authors)), nil
+}
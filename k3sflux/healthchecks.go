@@ -0,0 +1,73 @@
+package k3sflux
+
+import "strings"
+
+// HealthCheckResult is the outcome of one entry of a Kustomization's
+// spec.healthChecks.
+type HealthCheckResult struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Healthy   bool
+	// Message is the status kustomize-controller reported for the object
+	// when it failed, e.g. InProgress, or why it was not checked.
+	Message string
+}
+
+// KustomizationHealthChecks reports the outcome of each health check of a
+// Kustomization. kustomize-controller only records them together in the
+// Healthy condition, whose message names the failing objects as
+// Kind/namespace/name, so a check counts as passed unless it is named
+// there. Every check is unhealthy while the condition is missing, or when it
+// failed without naming any of them, e.g. on a canceled check. A
+// Kustomization without health checks returns an empty list.
+func (k *K8sInstance) KustomizationHealthChecks(name, namespace string) ([]HealthCheckResult, error) {
+	ks, err := k.kustomization(name, namespace)
+	if err != nil {
+		return nil, err
+	}
+	var healthy condition
+	for _, c := range ks.Status.Conditions {
+		if c.Type == "Healthy" {
+			healthy = c
+		}
+	}
+	results := make([]HealthCheckResult, 0, len(ks.Spec.HealthChecks))
+	named := false
+	for _, check := range ks.Spec.HealthChecks {
+		r := HealthCheckResult{Kind: check.Kind, Namespace: check.Namespace, Name: check.Name}
+		switch healthy.Status {
+		case "True":
+			r.Healthy = true
+		case "":
+			r.Message = "health checks have not run yet"
+		default:
+			r.Message, r.Healthy = healthCheckFailure(healthy.Message, check.Kind+"/"+check.Namespace+"/"+check.Name)
+			named = named || !r.Healthy
+		}
+		results = append(results, r)
+	}
+	if healthy.Status == "False" && !named {
+		for i := range results {
+			results[i].Healthy = false
+			results[i].Message = healthy.Message
+		}
+	}
+	return results, nil
+}
+
+// healthCheckFailure looks ref up in the message of a failed Healthy
+// condition, e.g. "timeout waiting for: [Deployment/apps/web status:
+// 'InProgress']", returning its status and whether it was not listed.
+func healthCheckFailure(message, ref string) (string, bool) {
+	i := strings.Index(message, ref+" ")
+	if i < 0 {
+		return "", true
+	}
+	status := message[i+len(ref)+1:]
+	if end := strings.IndexAny(status, ",]"); end >= 0 {
+		status = status[:end]
+	}
+	status = strings.TrimPrefix(status, "status: ")
+	return strings.Trim(status, "'"), false
+}
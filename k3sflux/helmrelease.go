@@ -0,0 +1,98 @@
+package k3sflux
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// helmRelease is the subset of a flux HelmRelease object the helpers read
+// back from the cluster.
+type helmRelease struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Status struct {
+		Conditions          []condition `json:"conditions"`
+		LastAppliedRevision string      `json:"lastAppliedRevision"`
+		History             []struct {
+			ChartVersion string `json:"chartVersion"`
+		} `json:"history"`
+	} `json:"status"`
+}
+
+// chartVersion is the chart version of the last release. helm-controller
+// records it in status.history from v2beta2 on, and as
+// status.lastAppliedRevision before.
+func (hr helmRelease) chartVersion() string {
+	if len(hr.Status.History) > 0 {
+		return hr.Status.History[0].ChartVersion
+	}
+	return hr.Status.LastAppliedRevision
+}
+
+// helmRelease fetches a HelmRelease.
+func (k *K8sInstance) helmRelease(name, namespace string) (*helmRelease, error) {
+	if err := k.requireFlux(); err != nil {
+		return nil, err
+	}
+	var hr helmRelease
+	if err := k.kubectlJSON(fmt.Sprintf("get helmreleases.helm.toolkit.fluxcd.io %s -n %s", name, namespace), &hr); err != nil {
+		return nil, fmt.Errorf("failed to get helmrelease %s/%s: %w", namespace, name, err)
+	}
+	return &hr, nil
+}
+
+// waitForHelmReleases waits for every HelmRelease in namespace, or in all
+// namespaces when it is empty, to be Ready. On timeout the releases that are
+// still not ready are listed in the error with their Ready condition.
+func (k *K8sInstance) waitForHelmReleases(namespace string, timeout time.Duration) error {
+	if err := k.requireFlux(); err != nil {
+		return err
+	}
+	scope := "-A"
+	if namespace != "" {
+		scope = "-n " + namespace
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		var list struct {
+			Items []helmRelease `json:"items"`
+		}
+		if err := k.kubectlJSON("get helmreleases.helm.toolkit.fluxcd.io "+scope, &list); err != nil {
+			return fmt.Errorf("failed to list helmreleases: %w", err)
+		}
+		var notReady []string
+		for _, hr := range list.Items {
+			ready := findReady(hr.Status.Conditions)
+			if ready.Status != "True" {
+				notReady = append(notReady, fmt.Sprintf("%s/%s (%s: %s)", hr.Metadata.Namespace, hr.Metadata.Name, ready.Reason, ready.Message))
+			}
+		}
+		if len(notReady) == 0 {
+			return nil
+		}
+		if time.Now().Add(podPollInterval).After(deadline) {
+			return fmt.Errorf("%d helmrelease(s) not ready after %v:\n%s", len(notReady), timeout, strings.Join(notReady, "\n"))
+		}
+		time.Sleep(podPollInterval)
+	}
+}
+
+// AssertHelmReleaseVersion checks that the HelmRelease deployed the expected
+// chart version.
+func (k *K8sInstance) AssertHelmReleaseVersion(name, namespace, expectedVersion string) error {
+	hr, err := k.helmRelease(name, namespace)
+	if err != nil {
+		return err
+	}
+	actual := hr.chartVersion()
+	if actual == "" {
+		return fmt.Errorf("helmrelease %s/%s has not deployed a chart yet, expected %s", namespace, name, expectedVersion)
+	}
+	if actual != expectedVersion {
+		return fmt.Errorf("helmrelease %s/%s deployed chart version %s, expected %s", namespace, name, actual, expectedVersion)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package k3sflux
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpCheckInterval is the pause between two HTTPCheck attempts.
+const httpCheckInterval = 5 * time.Second
+
+// HTTPCheck requests url from the tools container, which reaches the cluster
+// through the k3s service binding, until it answers with expectStatus or
+// timeout expires. Service DNS names only resolve through a port-forward or
+// an ingress exposed on the k3s host. On timeout the last status and body
+// are returned in the error.
+func (k *K8sInstance) HTTPCheck(url string, expectStatus int, timeout time.Duration) error {
+	// the status code is written on its own line after the body
+	command := fmt.Sprintf("curl -sS -k --max-time 10 -w '\\n%%{http_code}' %s", shellQuote(url))
+	deadline := time.Now().Add(timeout)
+	var lastStatus int
+	var lastBody string
+	var lastErr error
+	for {
+		res, err := k.exec("curl", command, true)
+		if err == nil {
+			lastErr = nil
+			lastBody, lastStatus = splitHTTPStatus(res.Stdout)
+			if lastStatus == expectStatus {
+				return nil
+			}
+		} else {
+			lastErr = err
+		}
+		if time.Now().Add(httpCheckInterval).After(deadline) {
+			break
+		}
+		time.Sleep(httpCheckInterval)
+	}
+	if lastErr != nil {
+		return fmt.Errorf("%s did not answer with %d within %v: %w", url, expectStatus, timeout, lastErr)
+	}
+	return fmt.Errorf("%s did not answer with %d within %v, last status %d: %s", url, expectStatus, timeout, lastStatus, lastBody)
+}
+
+// splitHTTPStatus separates the response body from the status code curl
+// appended to it.
+func splitHTTPStatus(out string) (string, int) {
+	out = strings.TrimRight(out, "\n")
+	i := strings.LastIndex(out, "\n")
+	status, _ := strconv.Atoi(strings.TrimSpace(out[i+1:]))
+	if i < 0 {
+		return "", status
+	}
+	return out[:i], status
+}
@@ -0,0 +1,96 @@
+package k3sflux
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// imageAutomationAuthor is the commit author looked for when no
+	// ImageUpdateAutomation names one.
+	imageAutomationAuthor = "fluxcdbot"
+	// imageUpdatePollInterval is the pause between two repository checks.
+	imageUpdatePollInterval = 10 * time.Second
+)
+
+// ImageUpdateTimeoutError is returned by WaitForImageUpdateCommit when no
+// image automation commit shows up within the timeout.
+type ImageUpdateTimeoutError struct {
+	Since   time.Time
+	Timeout time.Duration
+}
+
+func (e *ImageUpdateTimeoutError) Error() string {
+	return fmt.Sprintf("no image update commit since %s within %v", e.Since.Format(time.RFC3339), e.Timeout)
+}
+
+// imageAutomationAuthors lists the commit authors the ImageUpdateAutomation
+// objects of the cluster set in spec.git.commit.author, or
+// imageAutomationAuthor when none does.
+func (k *K8sInstance) imageAutomationAuthors() ([]string, error) {
+	var list struct {
+		Items []struct {
+			Spec struct {
+				Git struct {
+					Commit struct {
+						Author struct {
+							Name string `json:"name"`
+						} `json:"author"`
+					} `json:"commit"`
+				} `json:"git"`
+			} `json:"spec"`
+		} `json:"items"`
+	}
+	if err := k.kubectlJSON("get imageupdateautomations.image.toolkit.fluxcd.io -A", &list); err != nil {
+		return nil, fmt.Errorf("failed to list imageupdateautomations: %w", err)
+	}
+	seen := map[string]bool{}
+	var authors []string
+	for _, item := range list.Items {
+		if name := item.Spec.Git.Commit.Author.Name; name != "" && !seen[name] {
+			seen[name] = true
+			authors = append(authors, name)
+		}
+	}
+	if len(authors) == 0 {
+		return []string{imageAutomationAuthor}, nil
+	}
+	return authors, nil
+}
+
+// WaitForImageUpdateCommit polls the bootstrap branch for a commit authored
+// by the image-automation-controller after since and returns its SHA. The
+// commit author is the one the ImageUpdateAutomation objects configure. The
+// controller is only installed when Config.ComponentsExtra lists
+// image-reflector-controller and image-automation-controller.
+func (k *K8sInstance) WaitForImageUpdateCommit(since time.Time, timeout time.Duration) (string, error) {
+	authors, err := k.imageAutomationAuthors()
+	if err != nil {
+		return "", err
+	}
+	var filter strings.Builder
+	for _, author := range authors {
+		filter.WriteString(" --author=" + shellQuote(author))
+	}
+	dir := shellQuote(path.Join(k.workDir(), "image-updates"))
+	command := fmt.Sprintf(
+		"rm -rf %s && git clone -q --branch %s --single-branch %s %s && git -C %s log --since=@%d -F%s --format=%%H -1",
+		dir, k.cfg.Bootstrap.Branch, k.repoShellURL(), dir, dir, since.Unix(), filter.String(),
+	)
+	deadline := time.Now().Add(timeout)
+	for {
+		res, err := k.exec("image update", command, true)
+		if err != nil {
+			return "", fmt.Errorf("failed to check for image update commits: %w", err)
+		}
+		if sha := strings.TrimSpace(res.Stdout); sha != "" {
+			return sha, nil
+		}
+		if time.Now().Add(imageUpdatePollInterval).After(deadline) {
+			return "", &ImageUpdateTimeoutError{Since: since, Timeout: timeout}
+		}
+		time.Sleep(imageUpdatePollInterval)
+	}
+}
@@ -0,0 +1,523 @@
+package k3sflux
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// srcDir is where the git repository is mounted inside the tools container.
+const srcDir = "/src"
+
+const (
+	// defaultWaitRetries and defaultWaitBackoff pace waitForNodes when
+	// Config.WaitRetries and Config.WaitBackoff are zero.
+	defaultWaitRetries = 5
+	defaultWaitBackoff = 5 * time.Second
+	// defaultWorkDir is the working directory of the tools container when
+	// Config.WorkDir is empty.
+	defaultWorkDir = "/tmp"
+)
+
+// images the cluster and the tools container are assembled from.
+const (
+	// k3sImage is pinned so runs stay reproducible when upstream
+	// publishes a new latest tag, see Config.K3sVersion.
+	k3sImage = "rancher/k3s:v1.27.3-k3s1"
+	// kubectlImage, helmImage and fluxImage are the defaults of
+	// Config.ToolImages.
+	kubectlImage = "bitnami/kubectl"
+	helmImage    = "alpine/helm"
+	fluxImage    = "ghcr.io/fluxcd/flux-cli:v2.1.2"
+	toolsImage   = "cgr.dev/chainguard/wolfi-base:latest"
+)
+
+func NewK8sInstance(ctx context.Context, client *dagger.Client, cfg Config) *K8sInstance {
+	cfg.Bootstrap = cfg.Bootstrap.withDefaults()
+	return &K8sInstance{
+		ctx:         ctx,
+		client:      client,
+		cfg:         cfg,
+		container:   nil,
+		configCache: client.CacheVolume(configCacheName(cfg.Name)),
+		executor:    DaggerExecutor{},
+	}
+}
+
+type K8sInstance struct {
+	ctx       context.Context
+	client    *dagger.Client
+	cfg       Config
+	container *dagger.Container
+	// k3s is the k3s server service.
+	k3s         *dagger.Container
+	configCache *dagger.CacheVolume
+	registries  registriesConfig
+	executor    Executor
+	logs        execLogs
+	fluxFound   bool
+	// gitToken is the token read by WithGitTokenFile.
+	gitToken string
+	// sshKey and knownHosts are set by WithSSHAuth.
+	sshKey     *dagger.Secret
+	knownHosts string
+	// localManifests is the host directory set by WithLocalManifests.
+	localManifests string
+	// agentToken is the secret the agents join the server with.
+	agentToken string
+	// preRunHead is the bootstrap branch head recorded before the run.
+	preRunHead string
+	warnings   []string
+	// err holds the first error reported by a With* option, returned by start.
+	err error
+}
+
+// warnf logs a non-fatal problem and records it for the run result.
+func (k *K8sInstance) warnf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("warning: %s", msg)
+	k.warnings = append(k.warnings, msg)
+}
+
+func (k *K8sInstance) setErr(err error) {
+	if k.err == nil {
+		k.err = err
+	}
+}
+
+func (k *K8sInstance) start() error {
+	if k.err != nil {
+		return k.err
+	}
+	if err := k.requireSession("start"); err != nil {
+		return err
+	}
+	if k.cfg.ResetConfigCache {
+		if err := k.Cleanup(); err != nil {
+			return err
+		}
+	}
+	existing, err := k.prepareDataCache()
+	if err != nil {
+		return err
+	}
+
+	images := k.cfg.ToolImages.withDefaults()
+	if err := k.checkPlatform(k.k3sImage(), images.Kubectl, images.Helm, images.Flux, toolsImage); err != nil {
+		return err
+	}
+	if err := k.checkTools(); err != nil {
+		return err
+	}
+
+	var token *dagger.Secret
+	if k.cfg.Agents > 0 {
+		if token, err = k.joinToken(); err != nil {
+			return err
+		}
+	}
+
+	// create k3s service container, a new one on every start so a restart
+	// does not attach to the previous server
+	k3s := k.from(k.k3sImage()).Pipeline("k3s init").
+		With(withJoinToken(token)).
+		With(k.registriesFile).
+		WithMountedCache("/etc/rancher/k3s", k.configCache).
+		WithMountedTemp("/etc/lib/cni").
+		WithMountedTemp("/var/lib/kubelet").
+		With(k.dataMount).
+		WithMountedTemp("/var/log").
+		WithEnvVariable("CACHE", time.Now().String()).
+		WithEntrypoint([]string{"sh", "-c"}).
+		WithExec([]string{k.k3sServerCommand()}, dagger.ContainerWithExecOpts{InsecureRootCapabilities: true}).
+		WithExposedPort(6443)
+
+	gitRepo, err := k.diffSource()
+	if err != nil {
+		return err
+	}
+
+	k.k3s = k3s
+	k.container = k.toolsContainer().
+		WithMountedCache("/cache/k3s", k.configCache).
+		WithServiceBinding(k.serviceAlias(), k3s).
+		With(k.withAgents(k3s, token)).
+		WithEnvVariable("CACHE", time.Now().String()).
+		WithEnvVariable("KUBECONFIG", "/.kube/config").
+		WithSecretVariable("GITHUB_TOKEN", k.client.SetSecret("github-token", k.token())).
+		With(k.withGitAuth).
+		With(k.kubeconfigSetup).
+		WithDirectory(srcDir, gitRepo).
+		WithMountedTemp(k.workDir()).
+		WithWorkdir(k.workDir()).
+		With(k.localManifestsMount).
+		WithEntrypoint([]string{"sh", "-c"})
+
+	if err := k.waitForNodes(); err != nil {
+		if existing && k.cfg.OnExistingCluster == ExistingClusterReuse {
+			k.warnf("cluster reused from the k3s data cache is not ready, starting from an empty one: %v", err)
+			if err := k.wipeDataCache(); err != nil {
+				return err
+			}
+			return k.start()
+		}
+		return fmt.Errorf("failed to start k8s: %v", err)
+	}
+	return k.waitForAgents()
+}
+
+// workDir is the working directory of the tools container, Config.WorkDir
+// or /tmp.
+func (k *K8sInstance) workDir() string {
+	if k.cfg.WorkDir == "" {
+		return defaultWorkDir
+	}
+	return k.cfg.WorkDir
+}
+
+// CleanTemp gives the tools container a new, empty working directory. Each
+// command already starts from the container start built, so files written
+// by a command are not seen by the next one; CleanTemp is for clusters held
+// open by a long lived caller, dropping the scratch space the engine keeps
+// for the mount.
+func (k *K8sInstance) CleanTemp() error {
+	if k.container == nil {
+		return errors.New("the cluster has not been started")
+	}
+	k.container = k.container.WithMountedTemp(k.workDir())
+	return nil
+}
+
+// toolsContainer is the image the kubectl, helm, flux and git commands run
+// in, without any cluster attached.
+func (k *K8sInstance) toolsContainer() *dagger.Container {
+	return k.toolsContainerFor(k.cfg)
+}
+
+// toolsContainerFor is toolsContainer with the images and platform of cfg.
+func (k *K8sInstance) toolsContainerFor(cfg Config) *dagger.Container {
+	images := cfg.ToolImages.withDefaults()
+	from := func(image string) *dagger.Container { return k.fromPlatform(cfg.Platform, image) }
+	return from(toolsImage).
+		// From("alpine:latest").
+		WithFile("/usr/local/bin/kubectl", from(images.Kubectl).File("/opt/bitnami/kubectl/bin/kubectl")).
+		WithFile("/usr/local/bin/helm", from(images.Helm).File("/usr/bin/helm")).
+		WithFile("/usr/local/bin/flux", from(images.Flux).File("/usr/local/bin/flux")).
+		WithExec([]string{"apk", "add", "--no-cache", "curl", "jq", "openssh-client", "git"})
+}
+
+// toolVersionCommands print the version of each binary copied into the
+// tools container.
+var toolVersionCommands = []struct {
+	tool    string
+	command string
+}{
+	{"kubectl", "kubectl version --client"},
+	{"helm", "helm version --short"},
+	{"flux", "flux version --client"},
+}
+
+// checkTools runs every tool of the tools container once and logs its
+// version, so a Config.ToolImages image lacking its binary, or shipping one
+// for another platform, fails start instead of a later step.
+func (k *K8sInstance) checkTools() error {
+	tools := k.toolsContainer().WithEntrypoint([]string{"sh", "-c"})
+	for _, t := range toolVersionCommands {
+		res, err := k.execIn(tools, "tool versions", t.command, false)
+		if err != nil {
+			return fmt.Errorf("%s is missing or cannot run in the tools container: %w", t.tool, err)
+		}
+		log.Printf("%s: %s", t.tool, strings.Join(strings.Fields(res.Stdout), " "))
+	}
+	return nil
+}
+
+// k3sImage is the k3s image reference: Config.K3sVersion verbatim when it
+// names an image, rancher/k3s at that tag when it is only a version.
+func (k *K8sInstance) k3sImage() string {
+	v := k.cfg.K3sVersion
+	switch {
+	case v == "":
+		return k3sImage
+	case strings.ContainsAny(v, "/:@"):
+		return v
+	default:
+		return "rancher/k3s:" + v
+	}
+}
+
+// serviceAlias is the hostname the k3s service is bound to in the tools
+// container.
+func (k *K8sInstance) serviceAlias() string {
+	if k.cfg.Name == "" {
+		return "k3s"
+	}
+	return "k3s-" + k.cfg.Name
+}
+
+// k3sServerCommand assembles the shell command starting the k3s server.
+func (k *K8sInstance) k3sServerCommand() string {
+	args := []string{
+		"k3s server",
+		"--bind-address $(ip route | grep src | awk '{print $NF}')",
+	}
+	args = append(args, k.cfg.K3s.disableArgs()...)
+	if !k.registries.empty() {
+		args = append(args, "--private-registry "+registriesPath)
+	}
+	if k.cfg.Agents > 0 {
+		// the agents reach the server through its service alias
+		args = append(args, "--tls-san "+k.serviceAlias())
+	}
+	if k.cfg.KubeconfigPath != "" {
+		// ExportKubeconfig points at the service hostname
+		args = append(args, "--tls-san $(hostname)")
+	}
+	for _, arg := range mergeFeatureGates(k.cfg.FeatureGates, k.cfg.ExtraK3sServerArgs) {
+		args = append(args, shellQuote(arg))
+	}
+	return strings.Join(args, " ")
+}
+
+// registriesFile writes the registries.yaml k3s reads on startup, if any
+// registry option was set.
+func (k *K8sInstance) registriesFile(c *dagger.Container) *dagger.Container {
+	if k.registries.empty() {
+		return c
+	}
+	for _, host := range sortedKeys(k.registries.configs) {
+		if ca := k.registries.configs[host].caCert; ca != "" {
+			c = c.WithNewFile(caFile(host), dagger.ContainerWithNewFileOpts{Contents: ca})
+		}
+	}
+	return c.WithNewFile(registriesPath, dagger.ContainerWithNewFileOpts{Contents: k.registries.yaml()})
+}
+
+// kubeconfigSetup copies the kubeconfig written by k3s out of the shared
+// cache. Unless running rootless it does so as root and hands the file to
+// uid 1001, the user the bitnami kubectl binary expects.
+func (k *K8sInstance) kubeconfigSetup(c *dagger.Container) *dagger.Container {
+	if !k.cfg.Rootless {
+		c = c.WithUser("root")
+	}
+	for _, s := range kubeconfigSteps(k.cfg.Rootless) {
+		c = c.WithExec(s.args, dagger.ContainerWithExecOpts{SkipEntrypoint: s.skipEntrypoint})
+	}
+	return c
+}
+
+// kubeconfigStep is an exec of kubeconfigSetup.
+type kubeconfigStep struct {
+	args           []string
+	skipEntrypoint bool
+}
+
+// kubeconfigSteps are the execs of kubeconfigSetup, which only hand the
+// file to uid 1001 when not running rootless.
+func kubeconfigSteps(rootless bool) []kubeconfigStep {
+	steps := []kubeconfigStep{
+		{args: []string{"mkdir", "-p", "/.kube"}},
+		{args: []string{"cp", "/cache/k3s/k3s.yaml", "/.kube/config"}, skipEntrypoint: true},
+	}
+	if !rootless {
+		steps = append(steps, kubeconfigStep{args: []string{"chown", "1001:0", "/.kube/config"}, skipEntrypoint: true})
+	}
+	return steps
+}
+
+// rootlessHint points at Config.Rootless when err looks like a root
+// operation being refused by the engine.
+func rootlessHint(err error, rootless bool) error {
+	if rootless {
+		return err
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "chown") || strings.Contains(msg, "Operation not permitted") {
+		return fmt.Errorf("%w (root operations seem to be blocked, try Config.Rootless on rootless engines)", err)
+	}
+	return err
+}
+
+func (k *K8sInstance) kubectl(command string, cacheBust bool) (ExecResult, error) {
+	return k.exec("kubectl", fmt.Sprintf("kubectl %v", command), cacheBust)
+}
+
+// kubectlJSON runs a kubectl command with -o json and decodes the output
+// into out.
+func (k *K8sInstance) kubectlJSON(command string, out interface{}) error {
+	res, err := k.kubectl(command+" -o json", true)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(res.Stdout), out); err != nil {
+		return fmt.Errorf("failed to decode kubectl %s output: %w", command, err)
+	}
+	return nil
+}
+
+func (k *K8sInstance) helm(command string, cacheBust bool) (ExecResult, error) {
+	return k.exec("helm", fmt.Sprintf("helm %v", command), cacheBust)
+}
+
+func (k *K8sInstance) flux(command string, cacheBust bool) (ExecResult, error) {
+	return k.exec("flux", fmt.Sprintf("flux %v", command), cacheBust)
+}
+
+// FluxGetJSON runs flux get with the given arguments and -o json, decoding
+// the output into out. Subcommands lacking JSON output in the installed flux
+// version are reported as such rather than with the raw flag error.
+func (k *K8sInstance) FluxGetJSON(args []string, out interface{}) error {
+	if err := k.requireFlux(); err != nil {
+		return err
+	}
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	command := fmt.Sprintf("get %s -o json", strings.Join(quoted, " "))
+	res, err := k.flux(command, true)
+	if err != nil {
+		if strings.Contains(res.Stderr, "unknown shorthand flag: 'o'") || strings.Contains(res.Stderr, "unknown flag: --output") {
+			return fmt.Errorf("flux get %s does not support JSON output in this flux version", strings.Join(args, " "))
+		}
+		return fmt.Errorf("flux %s failed: %w", command, err)
+	}
+	if err := json.Unmarshal([]byte(res.Stdout), out); err != nil {
+		return fmt.Errorf("failed to decode flux %s output: %w", command, err)
+	}
+	return nil
+}
+
+func (k *K8sInstance) git(command string, cacheBust bool) (ExecResult, error) {
+	return k.exec("git", fmt.Sprintf("git %v", command), cacheBust)
+}
+
+// ExecResult is the outcome of a command run in the tools container. A
+// command exiting non-zero fills it too, next to the *dagger.ExecError or
+// *CommandError returned with it, so callers inspect the output without
+// unwrapping the error.
+type ExecResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// AlwaysBustCache makes every command run afresh, as all of them did before
+// cacheBust existed, for callers that do not trust a cached result.
+var AlwaysBustCache = false
+
+// exec runs command in the tools container. With cacheBust set the command
+// always runs; without it Dagger may answer with the output of the same
+// command run earlier in the same container. The tools container is rebuilt
+// on every start, so cached results never outlive the cluster, but within it
+// only commands whose output does not depend on the cluster state, such as
+// rendering manifests from the repository, or that run once per start may
+// skip cacheBust.
+func (k *K8sInstance) exec(name, command string, cacheBust bool) (ExecResult, error) {
+	return k.execIn(k.container, name, command, cacheBust)
+}
+
+// execIn runs command in c, a variant of the tools container carrying extra
+// mounts for the command.
+func (k *K8sInstance) execIn(c *dagger.Container, name, command string, cacheBust bool) (ExecResult, error) {
+	return k.execContext(k.ctx, c, name, command, cacheBust)
+}
+
+// execContext runs command in c through the Executor of the instance.
+func (k *K8sInstance) execContext(ctx context.Context, c *dagger.Container, name, command string, cacheBust bool) (ExecResult, error) {
+	res, err := k.executor.Exec(ctx, c, name, command, cacheBust || AlwaysBustCache)
+	k.logs.record(name, command, res, err)
+	return res, err
+}
+
+// waitDeadlineBuffer is how long a kubectl wait may overrun its own
+// --timeout before it is aborted.
+const waitDeadlineBuffer = 30 * time.Second
+
+// kubectlWait runs kubectl wait with args in c, adding --timeout.
+func (k *K8sInstance) kubectlWait(c *dagger.Container, args string, timeout time.Duration) (ExecResult, error) {
+	return k.kubectlDeadline(c, "wait "+args, timeout)
+}
+
+// kubectlDeadline runs a blocking kubectl command taking a --timeout in c.
+// kubectl only honors its timeout once it reached the API server, so the
+// exec is also bound by a context deadline slightly past it, aborting
+// commands that hang on a dead control plane.
+func (k *K8sInstance) kubectlDeadline(c *dagger.Container, command string, timeout time.Duration) (ExecResult, error) {
+	ctx, cancel := context.WithTimeout(k.ctx, timeout+waitDeadlineBuffer)
+	defer cancel()
+	res, err := k.execContext(ctx, c, "kubectl", fmt.Sprintf("kubectl %s --timeout=%s", command, timeout), true)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return res, fmt.Errorf("kubectl %s hung past its %v timeout, is the API server reachable?", command, timeout)
+	}
+	return res, err
+}
+
+// execFailure returns the output and exit code of a command that exited
+// non-zero carried by err, either a Dagger exec error or a CommandError.
+func execFailure(err error) (ExecResult, bool) {
+	var execErr *dagger.ExecError
+	if errors.As(err, &execErr) {
+		return ExecResult{Stdout: execErr.Stdout, Stderr: execErr.Stderr, ExitCode: execErr.ExitCode}, true
+	}
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.ExecResult, true
+	}
+	return ExecResult{}, false
+}
+
+// shellQuote quotes s for use as a single argument in the sh -c entrypoint.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// waitForNodes waits for a node to report the Ready condition, retrying
+// Config.WaitRetries times Config.WaitBackoff apart. When the last attempt
+// failed to reach the cluster, that failure is returned.
+func (k *K8sInstance) waitForNodes() error {
+	retries := k.cfg.WaitRetries
+	if retries == 0 {
+		retries = defaultWaitRetries
+	}
+	backoff := k.cfg.WaitBackoff
+	if backoff == 0 {
+		backoff = defaultWaitBackoff
+	}
+	var err error
+	for i := 0; i < retries; i++ {
+		time.Sleep(backoff)
+		var res ExecResult
+		res, err = k.exec("k3s-init", "kubectl get nodes -o json", true)
+		if err != nil {
+			err = rootlessHint(err, k.cfg.Rootless)
+			fmt.Println(fmt.Errorf("could not fetch nodes: %v", err))
+			continue
+		}
+		var list struct {
+			Items []node `json:"items"`
+		}
+		if err = json.Unmarshal([]byte(res.Stdout), &list); err != nil {
+			err = fmt.Errorf("failed to decode nodes: %w", err)
+			continue
+		}
+		var states []string
+		for _, n := range list.Items {
+			if n.ready() {
+				return nil
+			}
+			states = append(states, n.Metadata.Name+" not ready")
+		}
+		fmt.Println("waiting for k8s to start:", strings.Join(states, ", "))
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("no node became ready after %d attempts %v apart", retries, backoff)
+}
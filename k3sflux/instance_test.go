@@ -0,0 +1,144 @@
+package k3sflux
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// deadlineExecutor records the command and the context deadline of each
+// exec, failing with the context error once it is done.
+type deadlineExecutor struct {
+	command  string
+	deadline time.Time
+}
+
+func (e *deadlineExecutor) Exec(ctx context.Context, _ *dagger.Container, _, command string, _ bool) (ExecResult, error) {
+	e.command = command
+	e.deadline, _ = ctx.Deadline()
+	return ExecResult{}, ctx.Err()
+}
+
+func TestKubectlDeadline(t *testing.T) {
+	e := &deadlineExecutor{}
+	k := NewOfflineInstance(context.Background(), Config{}, e)
+	before := time.Now()
+	if _, err := k.kubectlWait(nil, "kustomization/apps --for=condition=ready -n flux-system", 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if want := "kubectl wait kustomization/apps --for=condition=ready -n flux-system --timeout=5m0s"; e.command != want {
+		t.Errorf("command = %q, want %q", e.command, want)
+	}
+	// the deadline falls waitDeadlineBuffer past the kubectl timeout
+	earliest := before.Add(5*time.Minute + waitDeadlineBuffer)
+	if e.deadline.Before(earliest) || e.deadline.After(time.Now().Add(5*time.Minute+waitDeadlineBuffer)) {
+		t.Errorf("deadline = %v, want %v past %v", e.deadline, 5*time.Minute+waitDeadlineBuffer, before)
+	}
+}
+
+func TestKubectlDeadlineHung(t *testing.T) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	k := NewOfflineInstance(ctx, Config{}, &deadlineExecutor{})
+	_, err := k.kubectlDeadline(nil, "rollout status deployment/web -n apps", time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "kubectl rollout status deployment/web -n apps hung past its 1m0s timeout") {
+		t.Errorf("kubectlDeadline() error = %v, want the hung command", err)
+	}
+}
+
+func TestKubeconfigSteps(t *testing.T) {
+	copySteps := []kubeconfigStep{
+		{args: []string{"mkdir", "-p", "/.kube"}},
+		{args: []string{"cp", "/cache/k3s/k3s.yaml", "/.kube/config"}, skipEntrypoint: true},
+	}
+	tests := []struct {
+		name     string
+		rootless bool
+		want     []kubeconfigStep
+	}{
+		{name: "root", want: append(copySteps, kubeconfigStep{args: []string{"chown", "1001:0", "/.kube/config"}, skipEntrypoint: true})},
+		{name: "rootless", rootless: true, want: copySteps},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := kubeconfigSteps(tt.rootless); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kubeconfigSteps() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRootlessHint(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		rootless bool
+		hinted   bool
+	}{
+		{name: "chown refused", err: errors.New("chown /.kube/config: operation failed"), hinted: true},
+		{name: "not permitted", err: errors.New("mkdir /.kube: Operation not permitted"), hinted: true},
+		{name: "already rootless", err: errors.New("mkdir /.kube: Operation not permitted"), rootless: true},
+		{name: "other failure", err: errors.New("connection refused")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rootlessHint(tt.err, tt.rootless)
+			if !errors.Is(got, tt.err) {
+				t.Errorf("rootlessHint() = %v, does not wrap %v", got, tt.err)
+			}
+			if hinted := strings.Contains(got.Error(), "try Config.Rootless"); hinted != tt.hinted {
+				t.Errorf("rootlessHint() = %q, want hint %v", got, tt.hinted)
+			}
+		})
+	}
+}
+
+func TestWorkDirCommands(t *testing.T) {
+	e := script(
+		step("get imageupdateautomations", ExecResult{Stdout: `{"items": []}`}),
+		step("git rev-parse HEAD", ExecResult{Stdout: "5f8c0d2e\n"}),
+		step("git clone", ExecResult{Stdout: "5f8c0d2e\n"}),
+		step("kustomize"),
+	)
+	k := NewOfflineInstance(context.Background(), Config{WorkDir: "/work"}, e)
+	k.localManifests = "manifests"
+	k.preRunHead = "5f8c0d2e"
+	helpers := map[string]func() error{
+		"ServerDryRunApply": func() error {
+			_, err := k.ServerDryRunApply("apps")
+			return err
+		},
+		"ApplyLocal": func() error {
+			_, err := k.ApplyLocal("apps")
+			return err
+		},
+		"CleanupGitCommits": func() error {
+			_, err := k.CleanupGitCommits()
+			return err
+		},
+		"WaitForImageUpdateCommit": func() error {
+			_, err := k.WaitForImageUpdateCommit(time.Unix(0, 0), time.Minute)
+			return err
+		},
+	}
+	for name, helper := range helpers {
+		if err := helper(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	for _, command := range e.commands {
+		if strings.Contains(command, "/tmp") {
+			t.Errorf("command %q does not use the WorkDir", command)
+		}
+	}
+	for _, file := range []string{"'/work/dry-run.yaml'", "'/work/local.yaml'", "'/work/cleanup'", "'/work/image-updates'"} {
+		if e.count(file) == 0 {
+			t.Errorf("no command uses %s, ran %q", file, e.commands)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package k3sflux
+
+import (
+	"fmt"
+	"strings"
+)
+
+// kustomization is the subset of a flux Kustomization object the helpers
+// read back from the cluster.
+type kustomization struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		Path  string `json:"path"`
+		Prune bool   `json:"prune"`
+		// DependsOn lists the Kustomizations that must be ready first, in
+		// the namespace of this one when Namespace is empty.
+		DependsOn []struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"dependsOn"`
+		HealthChecks []struct {
+			Kind      string `json:"kind"`
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"healthChecks"`
+	} `json:"spec"`
+	Status struct {
+		Conditions          []condition `json:"conditions"`
+		LastAppliedRevision string      `json:"lastAppliedRevision"`
+		Inventory           *struct {
+			Entries []struct {
+				ID      string `json:"id"`
+				Version string `json:"v"`
+			} `json:"entries"`
+		} `json:"inventory"`
+	} `json:"status"`
+}
+
+// condition is a status condition of a Kubernetes object.
+type condition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// readyCondition returns the Ready condition, or a zero condition when the
+// controller has not reported one yet.
+func (ks kustomization) readyCondition() condition {
+	return findReady(ks.Status.Conditions)
+}
+
+// findReady returns the Ready condition among conditions, or a zero
+// condition when there is none.
+func findReady(conditions []condition) condition {
+	for _, c := range conditions {
+		if c.Type == "Ready" {
+			return c
+		}
+	}
+	return condition{}
+}
+
+func (ks kustomization) key() string {
+	return ks.Metadata.Namespace + "/" + ks.Metadata.Name
+}
+
+// inventory returns the objects applied by the kustomization, or nil when it
+// has not recorded an inventory yet.
+func (ks kustomization) inventory() []ResourceRef {
+	if ks.Status.Inventory == nil {
+		return nil
+	}
+	refs := make([]ResourceRef, 0, len(ks.Status.Inventory.Entries))
+	for _, e := range ks.Status.Inventory.Entries {
+		ref, err := parseInventoryID(e.ID)
+		if err != nil {
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// kustomizations lists every flux Kustomization in the cluster.
+func (k *K8sInstance) kustomizations() ([]kustomization, error) {
+	if err := k.requireFlux(); err != nil {
+		return nil, err
+	}
+	var list struct {
+		Items []kustomization `json:"items"`
+	}
+	if err := k.kubectlJSON("get kustomizations.kustomize.toolkit.fluxcd.io -A", &list); err != nil {
+		return nil, fmt.Errorf("failed to list kustomizations: %w", err)
+	}
+	return list.Items, nil
+}
+
+// kustomization fetches a single flux Kustomization.
+func (k *K8sInstance) kustomization(name, namespace string) (*kustomization, error) {
+	if err := k.requireFlux(); err != nil {
+		return nil, err
+	}
+	var ks kustomization
+	if err := k.kubectlJSON(fmt.Sprintf("get kustomizations.kustomize.toolkit.fluxcd.io %s -n %s", name, namespace), &ks); err != nil {
+		return nil, fmt.Errorf("failed to get kustomization %s/%s: %w", namespace, name, err)
+	}
+	return &ks, nil
+}
+
+// discoverDiffTargets returns a diff target for every Kustomization matching
+// the label selector, using its spec.path as the path in the repository.
+func (k *K8sInstance) discoverDiffTargets(selector string) ([]DiffTarget, error) {
+	if err := k.requireFlux(); err != nil {
+		return nil, err
+	}
+	var list struct {
+		Items []kustomization `json:"items"`
+	}
+	if err := k.kubectlJSON("get kustomizations.kustomize.toolkit.fluxcd.io -A -l "+shellQuote(selector), &list); err != nil {
+		return nil, fmt.Errorf("failed to discover kustomizations matching %s: %w", selector, err)
+	}
+	targets := make([]DiffTarget, 0, len(list.Items))
+	for _, ks := range list.Items {
+		targets = append(targets, DiffTarget{
+			Name:      ks.Metadata.Name,
+			Namespace: ks.Metadata.Namespace,
+			Path:      ks.Spec.Path,
+		})
+	}
+	return targets, nil
+}
+
+// AppliedResources returns the objects flux applied, keyed by the
+// namespace/name of the Kustomization that owns them. Kustomizations that
+// have not applied anything yet map to an empty list.
+func (k *K8sInstance) AppliedResources() (map[string][]ResourceRef, error) {
+	items, err := k.kustomizations()
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[string][]ResourceRef, len(items))
+	for _, ks := range items {
+		refs := ks.inventory()
+		if refs == nil {
+			refs = []ResourceRef{}
+		}
+		applied[ks.key()] = refs
+	}
+	return applied, nil
+}
+
+// parseInventoryID parses the <namespace>_<name>_<group>_<kind> ids flux
+// stores in Kustomization inventories. Namespace and group are empty for
+// cluster scoped and core objects.
+func parseInventoryID(id string) (ResourceRef, error) {
+	parts := strings.Split(id, "_")
+	if len(parts) != 4 {
+		return ResourceRef{}, fmt.Errorf("malformed inventory id %q", id)
+	}
+	return ResourceRef{
+		Group:     parts[2],
+		Kind:      parts[3],
+		Namespace: parts[0],
+		Name:      parts[1],
+	}, nil
+}
@@ -0,0 +1,71 @@
+package k3sflux
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// featureGateComponents are the k3s flags passing arguments to the
+// components whose feature gates Config.FeatureGates sets.
+var featureGateComponents = []string{"--kube-apiserver-arg", "--kubelet-arg"}
+
+// mergeFeatureGates returns extra with the feature gates merged in. Any
+// --kube-apiserver-arg=feature-gates=... or --kubelet-arg=feature-gates=...
+// found in extra, also split in two arguments as in
+// --kubelet-arg feature-gates=..., is folded into a single flag per
+// component, gates wins over extra for a gate set in both, and the gates are
+// sorted so the command is stable.
+func mergeFeatureGates(gates map[string]bool, extra []string) []string {
+	merged := map[string]map[string]string{}
+	var args []string
+	for i := 0; i < len(extra); i++ {
+		arg := extra[i]
+		component, list, ok := featureGateArg(arg)
+		if !ok && i+1 < len(extra) {
+			// the split form, the flag and its value as two arguments
+			if component, list, ok = featureGateArg(arg + "=" + extra[i+1]); ok {
+				i++
+			}
+		}
+		if !ok {
+			args = append(args, arg)
+			continue
+		}
+		if merged[component] == nil {
+			merged[component] = map[string]string{}
+		}
+		for _, gate := range strings.Split(list, ",") {
+			name, value, _ := strings.Cut(gate, "=")
+			merged[component][name] = value
+		}
+	}
+	for _, component := range featureGateComponents {
+		if len(gates) == 0 && merged[component] == nil {
+			continue
+		}
+		if merged[component] == nil {
+			merged[component] = map[string]string{}
+		}
+		for name, enabled := range gates {
+			merged[component][name] = strconv.FormatBool(enabled)
+		}
+		var list []string
+		for _, name := range sortedKeys(merged[component]) {
+			list = append(list, name+"="+merged[component][name])
+		}
+		args = append(args, fmt.Sprintf("%s=feature-gates=%s", component, strings.Join(list, ",")))
+	}
+	return args
+}
+
+// featureGateArg splits a feature-gates k3s argument into its component
+// flag and gate list.
+func featureGateArg(arg string) (string, string, bool) {
+	for _, component := range featureGateComponents {
+		if list, ok := strings.CutPrefix(arg, component+"=feature-gates="); ok {
+			return component, list, true
+		}
+	}
+	return "", "", false
+}
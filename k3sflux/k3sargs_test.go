@@ -0,0 +1,61 @@
+package k3sflux
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeFeatureGates(t *testing.T) {
+	tests := []struct {
+		name  string
+		gates map[string]bool
+		extra []string
+		want  []string
+	}{
+		{
+			name:  "nothing to merge",
+			extra: []string{"--disable=traefik"},
+			want:  []string{"--disable=traefik"},
+		},
+		{
+			name:  "gates only",
+			gates: map[string]bool{"b": false, "a": true},
+			want: []string{
+				"--kube-apiserver-arg=feature-gates=a=true,b=false",
+				"--kubelet-arg=feature-gates=a=true,b=false",
+			},
+		},
+		{
+			name:  "gates win over extra",
+			gates: map[string]bool{"a": true},
+			extra: []string{"--kubelet-arg=feature-gates=a=false,c=true", "--disable=traefik"},
+			want: []string{
+				"--disable=traefik",
+				"--kube-apiserver-arg=feature-gates=a=true",
+				"--kubelet-arg=feature-gates=a=true,c=true",
+			},
+		},
+		{
+			name:  "extra flags folded per component",
+			extra: []string{"--kubelet-arg=feature-gates=a=true", "--kubelet-arg=feature-gates=b=true"},
+			want:  []string{"--kubelet-arg=feature-gates=a=true,b=true"},
+		},
+		{
+			name:  "split flag and value",
+			gates: map[string]bool{"a": true},
+			extra: []string{"--kubelet-arg", "feature-gates=b=false", "--kubelet-arg", "max-pods=200"},
+			want: []string{
+				"--kubelet-arg", "max-pods=200",
+				"--kube-apiserver-arg=feature-gates=a=true",
+				"--kubelet-arg=feature-gates=a=true,b=false",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeFeatureGates(tt.gates, tt.extra); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeFeatureGates() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package k3sflux
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// k3sKubeconfig is the kubeconfig k3s writes, as seen from the tools
+// container through the config cache.
+const k3sKubeconfig = "/cache/k3s/k3s.yaml"
+
+// ExportKubeconfig writes the kubeconfig of the cluster to hostPath, with
+// the server address rewritten to the endpoint of the k3s service, for
+// pointing kubectl or k9s at the cluster while it runs. Dagger cannot
+// tunnel services to the host, so the endpoint resolves on the engine
+// network; on a local engine it is reachable from the host through the
+// engine container's network.
+func (k *K8sInstance) ExportKubeconfig(hostPath string) error {
+	if err := k.requireSession("ExportKubeconfig"); err != nil {
+		return err
+	}
+	if k.k3s == nil {
+		return fmt.Errorf("cluster is not started")
+	}
+	endpoint, err := k.k3s.Endpoint(k.ctx, dagger.ContainerEndpointOpts{Port: 6443, Scheme: "https"})
+	if err != nil {
+		return fmt.Errorf("failed to resolve the k3s endpoint: %w", err)
+	}
+	res, err := k.exec("kubeconfig", fmt.Sprintf("test -s %s && echo found || echo missing", k3sKubeconfig), true)
+	if err != nil {
+		return fmt.Errorf("failed to look up the kubeconfig: %w", err)
+	}
+	if strings.TrimSpace(res.Stdout) != "found" {
+		return fmt.Errorf("k3s has not written %s yet", k3sKubeconfig)
+	}
+	kubeconfig := path.Join(k.workDir(), "kubeconfig")
+	_, err = k.container.
+		WithEnvVariable("CACHE", time.Now().String()).
+		WithExec([]string{fmt.Sprintf("sed -E 's|server: https://.*|server: %s|' %s > %s", endpoint, k3sKubeconfig, shellQuote(kubeconfig))}).
+		File(kubeconfig).
+		Export(k.ctx, hostPath)
+	if err != nil {
+		return fmt.Errorf("failed to export the kubeconfig to %s: %w", hostPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package k3sflux
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"dagger.io/dagger"
+)
+
+// hostDir is where the directory set by WithLocalManifests is mounted
+// inside the tools container.
+const hostDir = "/host"
+
+// WithLocalManifests mounts the host directory hostPath into the tools
+// container, so uncommitted manifests can be diffed with LocalTarget or
+// applied with ApplyLocal before they are pushed to the flux repository.
+// The git based flows are unaffected. It must be called before start; a
+// missing directory is reported by start.
+func (k *K8sInstance) WithLocalManifests(hostPath string) *K8sInstance {
+	info, err := os.Stat(hostPath)
+	if err != nil {
+		k.setErr(fmt.Errorf("failed to read local manifests: %w", err))
+		return k
+	}
+	if !info.IsDir() {
+		k.setErr(fmt.Errorf("local manifests %s is not a directory", hostPath))
+		return k
+	}
+	k.localManifests = hostPath
+	return k
+}
+
+// localManifestsMount mounts the WithLocalManifests directory, if any.
+func (k *K8sInstance) localManifestsMount(c *dagger.Container) *dagger.Container {
+	if k.localManifests == "" {
+		return c
+	}
+	return c.WithDirectory(hostDir, k.client.Host().Directory(k.localManifests))
+}
+
+// LocalTarget is the diff target of kustomization name with its desired
+// state at p in the WithLocalManifests directory rather than the cloned
+// repository.
+func LocalTarget(name, p string) DiffTarget {
+	return DiffTarget{Name: name, Path: p, SourceRoot: hostDir}
+}
+
+// ApplyLocal renders the kustomization at p, relative to the
+// WithLocalManifests directory, and applies it to the cluster.
+func (k *K8sInstance) ApplyLocal(p string) (string, error) {
+	if k.localManifests == "" {
+		return "", fmt.Errorf("no local manifests to apply %s from, see WithLocalManifests", p)
+	}
+	dir := shellQuote(path.Join(hostDir, p))
+	rendered := shellQuote(path.Join(k.workDir(), "local.yaml"))
+	res, err := k.kubectl(fmt.Sprintf("kustomize %s > %s && kubectl apply -f %s", dir, rendered, rendered), true)
+	if err != nil {
+		return "", fmt.Errorf("failed to apply local manifests %s: %w", p, err)
+	}
+	return res.Stdout, nil
+}
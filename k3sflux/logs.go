@@ -0,0 +1,56 @@
+package k3sflux
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// execLogs collects the output of every exec, per pipeline name.
+type execLogs struct {
+	mu   sync.Mutex
+	logs map[string]*strings.Builder
+}
+
+func (l *execLogs) record(pipeline, command string, res ExecResult, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.logs == nil {
+		l.logs = map[string]*strings.Builder{}
+	}
+	b, ok := l.logs[pipeline]
+	if !ok {
+		b = &strings.Builder{}
+		l.logs[pipeline] = b
+	}
+	fmt.Fprintf(b, "$ %s\n", command)
+	b.WriteString(res.Stdout + res.Stderr)
+	if _, ok := execFailure(err); ok {
+		fmt.Fprintf(b, "[exit code %d]\n", res.ExitCode)
+	} else if err != nil {
+		fmt.Fprintf(b, "[error] %v\n", err)
+	}
+	b.WriteString("\n")
+}
+
+// ExportLogs writes the output of each pipeline run so far to its own file in
+// dir, named after the pipeline (k3s-init.log, bootstrap.log,
+// diff-apps.log...). Every file is attempted even if one fails, the first
+// error is returned.
+func (k *K8sInstance) ExportLogs(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	k.logs.mu.Lock()
+	defer k.logs.mu.Unlock()
+	var firstErr error
+	for _, pipeline := range sortedKeys(k.logs.logs) {
+		file := filepath.Join(dir, strings.ReplaceAll(pipeline, " ", "-")+".log")
+		if err := os.WriteFile(file, []byte(k.logs.logs[pipeline].String()), 0o644); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to write %s: %w", file, err)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,75 @@
+package k3sflux
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// RunMatrix runs the whole workflow once per config, at most concurrency at
+// a time (all at once when it is zero or less). Each config needs a distinct
+// Name, which gives its cluster its own cache volume and service alias.
+// Each instance is configured like Execute configures its own, including the
+// git token file, SSH auth and registry settings of the config. The
+// results are in the order of configs; the error lists the configs whose
+// run failed.
+func RunMatrix(ctx context.Context, client *dagger.Client, configs []Config, concurrency int) ([]*RunResult, error) {
+	seen := map[string]bool{}
+	for _, cfg := range configs {
+		if seen[cfg.Name] {
+			return nil, fmt.Errorf("matrix configs need distinct names, %q is used twice", cfg.Name)
+		}
+		seen[cfg.Name] = true
+	}
+	if concurrency <= 0 {
+		concurrency = len(configs)
+	}
+
+	results := make([]*RunResult, len(configs))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, cfg := range configs {
+		wg.Add(1)
+		go func(i int, cfg Config) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = newConfiguredInstance(ctx, client, cfg).Run()
+		}(i, cfg)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, r := range results {
+		if r.Failed() {
+			failed = append(failed, configs[i].Name)
+		}
+	}
+	if len(failed) > 0 {
+		return results, fmt.Errorf("%d of %d matrix runs failed: %s", len(failed), len(configs), strings.Join(failed, ", "))
+	}
+	return results, nil
+}
+
+// MatrixReport compares the results of RunMatrix side by side, one line per
+// config with its outcome and drifted kustomizations.
+func MatrixReport(configs []Config, results []*RunResult) string {
+	var b strings.Builder
+	for i, r := range results {
+		status := "pass"
+		if r.Failed() {
+			status = "FAIL: " + r.Error
+		}
+		drifted := r.Drifted()
+		drift := "no drift"
+		if len(drifted) > 0 {
+			drift = "drift in " + strings.Join(drifted, ", ")
+		}
+		fmt.Fprintf(&b, "%s: %s, %s (%v)\n", configs[i].Name, status, drift, r.Finished.Sub(r.Started).Round(time.Second))
+	}
+	return b.String()
+}
@@ -0,0 +1,104 @@
+package k3sflux
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// fluxMetricsControllers are the flux controllers FluxMetrics scrapes.
+var fluxMetricsControllers = []string{"kustomize-controller", "helm-controller"}
+
+// fluxMetricsPort is the port the flux controllers serve /metrics on.
+const fluxMetricsPort = 8080
+
+// FluxMetrics scrapes the Prometheus metrics of the kustomize and helm
+// controllers through the API server pod proxy, so no port-forward is
+// needed. The text expositions are returned one after the other, each
+// preceded by a comment naming its controller; ParseReconcileMetrics picks
+// the reconciliation counters out of it.
+func (k *K8sInstance) FluxMetrics() (string, error) {
+	if err := k.requireFlux(); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, controller := range fluxMetricsControllers {
+		var list struct {
+			Items []pod `json:"items"`
+		}
+		if err := k.kubectlJSON("get pods -n flux-system -l app="+controller, &list); err != nil {
+			return "", fmt.Errorf("failed to find the %s pod: %w", controller, err)
+		}
+		if len(list.Items) == 0 {
+			return "", fmt.Errorf("no %s pod found in flux-system", controller)
+		}
+		res, err := k.kubectl(fmt.Sprintf("get --raw /api/v1/namespaces/flux-system/pods/%s:%d/proxy/metrics", list.Items[0].Metadata.Name, fluxMetricsPort), true)
+		if err != nil {
+			return "", fmt.Errorf("failed to scrape %s metrics: %w", controller, err)
+		}
+		fmt.Fprintf(&b, "# controller %s\n%s", controller, res.Stdout)
+	}
+	return b.String(), nil
+}
+
+// ReconcileMetrics are the reconciliation counters of the flux controllers,
+// keyed by controller-runtime controller name, e.g. kustomization or
+// helmrelease.
+type ReconcileMetrics struct {
+	Reconciles map[string]float64
+	Errors     map[string]float64
+	// DurationSeconds is the total time spent reconciling, keyed by kind.
+	DurationSeconds map[string]float64
+}
+
+// ParseReconcileMetrics extracts the reconciliation counters from the
+// output of FluxMetrics.
+func ParseReconcileMetrics(text string) ReconcileMetrics {
+	m := ReconcileMetrics{
+		Reconciles:      map[string]float64{},
+		Errors:          map[string]float64{},
+		DurationSeconds: map[string]float64{},
+	}
+	for _, line := range strings.Split(text, "\n") {
+		name, labels, value, ok := parseMetricLine(line)
+		if !ok {
+			continue
+		}
+		switch name {
+		case "controller_runtime_reconcile_total":
+			m.Reconciles[labels["controller"]] += value
+		case "controller_runtime_reconcile_errors_total":
+			m.Errors[labels["controller"]] += value
+		case "gotk_reconcile_duration_seconds_sum":
+			m.DurationSeconds[labels["kind"]] += value
+		}
+	}
+	return m
+}
+
+// parseMetricLine parses a sample of the Prometheus text format, e.g.
+//
+//	controller_runtime_reconcile_total{controller="kustomization",result="success"} 12
+func parseMetricLine(line string) (string, map[string]string, float64, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, 0, false
+	}
+	i := strings.LastIndex(line, " ")
+	if i < 0 {
+		return "", nil, 0, false
+	}
+	value, err := strconv.ParseFloat(line[i+1:], 64)
+	if err != nil {
+		return "", nil, 0, false
+	}
+	name, rest, _ := strings.Cut(line[:i], "{")
+	labels := map[string]string{}
+	for _, pair := range strings.Split(strings.TrimSuffix(rest, "}"), ",") {
+		key, v, ok := strings.Cut(pair, "=")
+		if ok {
+			labels[key] = strings.Trim(v, `"`)
+		}
+	}
+	return name, labels, value, true
+}
@@ -0,0 +1,93 @@
+package k3sflux
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrNotificationNotInstalled is returned by the alerting helpers when the
+// cluster has no notification-controller CRDs, e.g. because it was left out
+// of the bootstrap components.
+var ErrNotificationNotInstalled = errors.New("flux notification-controller is not installed in the cluster")
+
+const (
+	alertResource    = "alerts.notification.toolkit.fluxcd.io"
+	providerResource = "providers.notification.toolkit.fluxcd.io"
+)
+
+// Provider is a notification-controller Provider with its Ready condition.
+type Provider struct {
+	Name      string
+	Namespace string
+	// Type is the provider type, e.g. slack or github.
+	Type    string
+	Ready   bool
+	Reason  string
+	Message string
+}
+
+// requireNotification returns ErrNotificationNotInstalled when the Alert CRD
+// is missing.
+func (k *K8sInstance) requireNotification() error {
+	res, err := k.kubectl("get crd "+alertResource+" --ignore-not-found -o name", true)
+	if err != nil {
+		return fmt.Errorf("failed to look up notification-controller CRDs: %w", err)
+	}
+	if strings.TrimSpace(res.Stdout) == "" {
+		return ErrNotificationNotInstalled
+	}
+	return nil
+}
+
+// GetProviders lists the notification Providers of every namespace.
+func (k *K8sInstance) GetProviders() ([]Provider, error) {
+	if err := k.requireNotification(); err != nil {
+		return nil, err
+	}
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"metadata"`
+			Spec struct {
+				Type string `json:"type"`
+			} `json:"spec"`
+			Status struct {
+				Conditions []condition `json:"conditions"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := k.kubectlJSON("get "+providerResource+" -A", &list); err != nil {
+		return nil, fmt.Errorf("failed to list providers: %w", err)
+	}
+	providers := make([]Provider, 0, len(list.Items))
+	for _, item := range list.Items {
+		ready := findReady(item.Status.Conditions)
+		providers = append(providers, Provider{
+			Name:      item.Metadata.Name,
+			Namespace: item.Metadata.Namespace,
+			Type:      item.Spec.Type,
+			Ready:     ready.Status == "True",
+			Reason:    ready.Reason,
+			Message:   ready.Message,
+		})
+	}
+	return providers, nil
+}
+
+// WaitForAlert waits for an Alert to be Ready, meaning the
+// notification-controller accepted it and its Provider, so the events it
+// selects are forwarded.
+func (k *K8sInstance) WaitForAlert(name, namespace string, timeout time.Duration) error {
+	if err := k.requireNotification(); err != nil {
+		return err
+	}
+	_, err := k.kubectlWait(k.container, fmt.Sprintf("%s/%s -n %s --for=condition=ready", alertResource, name, namespace), timeout)
+	if err != nil {
+		return fmt.Errorf("alert %s/%s did not become ready: %w%s", namespace, name, err, k.readyStatus(alertResource, name, namespace))
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package k3sflux
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ReconcileOrder returns the Kustomizations of the cluster, as namespace/name,
+// grouped in the layers flux applies them in: the first layer depends on
+// nothing, every later one only on the layers before it. A dependency cycle,
+// which flux would never get past, is returned as an error naming it.
+func (k *K8sInstance) ReconcileOrder() ([][]string, error) {
+	items, err := k.kustomizations()
+	if err != nil {
+		return nil, err
+	}
+	deps := map[string][]string{}
+	for _, ks := range items {
+		key := ks.key()
+		deps[key] = nil
+		for _, d := range ks.Spec.DependsOn {
+			namespace := d.Namespace
+			if namespace == "" {
+				namespace = ks.Metadata.Namespace
+			}
+			deps[key] = append(deps[key], namespace+"/"+d.Name)
+		}
+	}
+	return dependencyLayers(deps)
+}
+
+// dependencyLayers sorts the nodes of the dependency graph deps, mapping
+// each node to the ones it depends on, in topological layers.
+func dependencyLayers(deps map[string][]string) ([][]string, error) {
+	for node, on := range deps {
+		for _, d := range on {
+			if _, ok := deps[d]; !ok {
+				return nil, fmt.Errorf("kustomization %s depends on %s, which does not exist", node, d)
+			}
+		}
+	}
+	done := map[string]bool{}
+	var layers [][]string
+	for len(done) < len(deps) {
+		var layer []string
+		for node, on := range deps {
+			if done[node] {
+				continue
+			}
+			ready := true
+			for _, d := range on {
+				ready = ready && done[d]
+			}
+			if ready {
+				layer = append(layer, node)
+			}
+		}
+		if len(layer) == 0 {
+			return nil, fmt.Errorf("dependency cycle: %s", strings.Join(findCycle(deps, done), " -> "))
+		}
+		sort.Strings(layer)
+		for _, node := range layer {
+			done[node] = true
+		}
+		layers = append(layers, layer)
+	}
+	return layers, nil
+}
+
+// findCycle returns a cycle among the nodes not done yet, each of which
+// waits on another one of them, starting and ending with the same node.
+func findCycle(deps map[string][]string, done map[string]bool) []string {
+	var start string
+	for _, node := range sortedKeys(deps) {
+		if !done[node] {
+			start = node
+			break
+		}
+	}
+	// walk pending dependencies until a node repeats
+	seen := map[string]int{}
+	var path []string
+	for node := start; ; {
+		if i, ok := seen[node]; ok {
+			return append(path[i:], node)
+		}
+		seen[node] = len(path)
+		path = append(path, node)
+		for _, d := range deps[node] {
+			if !done[d] {
+				node = d
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package k3sflux
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDependencyLayers(t *testing.T) {
+	tests := []struct {
+		name    string
+		deps    map[string][]string
+		want    [][]string
+		wantErr string
+	}{
+		{
+			name: "independent",
+			deps: map[string][]string{"flux-system/b": nil, "flux-system/a": nil},
+			want: [][]string{{"flux-system/a", "flux-system/b"}},
+		},
+		{
+			name: "chain and fan in",
+			deps: map[string][]string{
+				"flux-system/apps":     {"flux-system/infra", "flux-system/crds"},
+				"flux-system/infra":    {"flux-system/crds"},
+				"flux-system/crds":     nil,
+				"flux-system/monitors": {"flux-system/crds"},
+			},
+			want: [][]string{
+				{"flux-system/crds"},
+				{"flux-system/infra", "flux-system/monitors"},
+				{"flux-system/apps"},
+			},
+		},
+		{
+			name:    "missing dependency",
+			deps:    map[string][]string{"flux-system/apps": {"flux-system/infra"}},
+			wantErr: "kustomization flux-system/apps depends on flux-system/infra, which does not exist",
+		},
+		{
+			name: "cycle",
+			deps: map[string][]string{
+				"flux-system/a":    {"flux-system/b"},
+				"flux-system/b":    {"flux-system/c"},
+				"flux-system/c":    {"flux-system/a"},
+				"flux-system/base": nil,
+			},
+			wantErr: "dependency cycle: flux-system/a -> flux-system/b -> flux-system/c -> flux-system/a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dependencyLayers(tt.deps)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("dependencyLayers() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dependencyLayers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
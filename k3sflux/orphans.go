@@ -0,0 +1,79 @@
+package k3sflux
+
+import "strings"
+
+// defaultOrphanSkipKinds are kinds created by Kubernetes itself rather than
+// by anyone applying manifests, ignored by FindOrphans unless
+// Config.OrphanSkipKinds overrides them.
+var defaultOrphanSkipKinds = []string{
+	"Event",
+	"Endpoints",
+	"EndpointSlice",
+	"Lease",
+	"PodMetrics",
+}
+
+// defaultOrphanSkipNames are objects every namespace gets automatically.
+var defaultOrphanSkipNames = []ResourceRef{
+	{Kind: "ConfigMap", Name: "kube-root-ca.crt"},
+	{Kind: "ServiceAccount", Name: "default"},
+}
+
+// ref returns the reference of a listed object.
+func (o object) ref() ResourceRef {
+	group := ""
+	if i := strings.LastIndex(o.APIVersion, "/"); i >= 0 {
+		group = o.APIVersion[:i]
+	}
+	return ResourceRef{Group: group, Kind: o.Kind, Namespace: o.Metadata.Namespace, Name: o.Metadata.Name}
+}
+
+// FindOrphans lists the objects in the namespaces that no flux Kustomization
+// applied, e.g. created by hand or leaked by a removed kustomization.
+// Objects owned by another object (pods of a ReplicaSet...), the kinds in
+// Config.OrphanSkipKinds and the objects Kubernetes adds to every namespace
+// are not reported.
+func (k *K8sInstance) FindOrphans(namespaces []string) ([]ResourceRef, error) {
+	applied, err := k.AppliedResources()
+	if err != nil {
+		return nil, err
+	}
+	managed := map[ResourceRef]bool{}
+	for _, refs := range applied {
+		for _, ref := range refs {
+			managed[ref] = true
+		}
+	}
+	objects, err := k.liveObjects(namespaces)
+	if err != nil {
+		return nil, err
+	}
+
+	skipKinds := k.cfg.OrphanSkipKinds
+	if skipKinds == nil {
+		skipKinds = defaultOrphanSkipKinds
+	}
+	skip := map[string]bool{}
+	for _, kind := range skipKinds {
+		skip[kind] = true
+	}
+
+	var orphans []ResourceRef
+	for _, o := range objects {
+		ref := o.ref()
+		if managed[ref] || skip[o.Kind] || len(o.Metadata.OwnerReferences) > 0 || skippedName(ref) {
+			continue
+		}
+		orphans = append(orphans, ref)
+	}
+	return orphans, nil
+}
+
+func skippedName(ref ResourceRef) bool {
+	for _, s := range defaultOrphanSkipNames {
+		if s.Kind == ref.Kind && s.Name == ref.Name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package k3sflux
+
+import (
+	"fmt"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// from returns a container from image for Config.Platform, the engine host
+// platform when empty.
+func (k *K8sInstance) from(image string) *dagger.Container {
+	return k.fromPlatform(k.cfg.Platform, image)
+}
+
+// fromPlatform is from for the given Config.Platform.
+func (k *K8sInstance) fromPlatform(platform, image string) *dagger.Container {
+	return k.client.Container(dagger.ContainerOpts{Platform: dagger.Platform(platform)}).From(image)
+}
+
+// checkPlatform pulls the images of the run ahead of start when
+// Config.Platform is set, so an image without a build for it is named in
+// the error rather than showing up as a failing exec further down. The pull
+// runs a no-op shell command in each image, which all ship a shell.
+func (k *K8sInstance) checkPlatform(images ...string) error {
+	if k.cfg.Platform == "" {
+		return nil
+	}
+	for _, image := range images {
+		c := k.sessionContainer(func() *dagger.Container {
+			return k.from(image).WithEntrypoint([]string{"sh", "-c"})
+		})
+		_, err := k.execIn(c, "platform", "true", false)
+		if err == nil {
+			continue
+		}
+		if strings.Contains(err.Error(), "no match for platform") {
+			return fmt.Errorf("image %s has no %s build", image, k.cfg.Platform)
+		}
+		return fmt.Errorf("failed to pull %s for %s: %w", image, k.cfg.Platform, err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package k3sflux
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCheckPlatform(t *testing.T) {
+	noBuild := ExecResult{Stderr: "no match for platform in manifest: not found", ExitCode: 1}
+	tests := []struct {
+		name     string
+		platform string
+		results  []ExecResult
+		pulls    int
+		wantErr  string
+	}{
+		{name: "host platform", pulls: 0},
+		{name: "every image built", platform: "linux/arm64", results: []ExecResult{{}}, pulls: 2},
+		{name: "image without a build", platform: "linux/arm64", results: []ExecResult{{}, noBuild}, pulls: 2, wantErr: "image ghcr.io/fluxcd/flux-cli:v2.0.0 has no linux/arm64 build"},
+		{name: "pull failure", platform: "linux/arm64", results: []ExecResult{{Stderr: "connection refused", ExitCode: 1}}, pulls: 1, wantErr: "failed to pull rancher/k3s:v1.27.3-k3s1 for linux/arm64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := script(step("true", tt.results...))
+			k := NewOfflineInstance(context.Background(), Config{Platform: tt.platform}, e)
+			err := k.checkPlatform("rancher/k3s:v1.27.3-k3s1", "ghcr.io/fluxcd/flux-cli:v2.0.0")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkPlatform() error = %v, want %q", err, tt.wantErr)
+			}
+			if got := e.count("true"); got != tt.pulls {
+				t.Errorf("pulled %d images, want %d", got, tt.pulls)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package k3sflux
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// systemNamespaces hold the pods the apps depend on, such as coredns and the
+// flux controllers.
+var systemNamespaces = []string{"kube-system", "flux-system"}
+
+// podPollInterval is the pause between two pod status checks.
+const podPollInterval = 5 * time.Second
+
+// pod is the subset of a Pod object the helpers read back from the cluster.
+type pod struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Status struct {
+		Phase      string      `json:"phase"`
+		Conditions []condition `json:"conditions"`
+	} `json:"status"`
+}
+
+// ready reports whether the pod is running with all containers ready, or
+// completed successfully like the k3s helm install jobs.
+func (p pod) ready() bool {
+	if p.Status.Phase == "Succeeded" {
+		return true
+	}
+	if p.Status.Phase != "Running" {
+		return false
+	}
+	for _, c := range p.Status.Conditions {
+		if c.Type == "Ready" {
+			return c.Status == "True"
+		}
+	}
+	return false
+}
+
+// pods lists the pods of a namespace.
+func (k *K8sInstance) pods(namespace string) ([]pod, error) {
+	var list struct {
+		Items []pod `json:"items"`
+	}
+	if err := k.kubectlJSON("get pods -n "+namespace, &list); err != nil {
+		return nil, fmt.Errorf("failed to list pods in %s: %w", namespace, err)
+	}
+	return list.Items, nil
+}
+
+// WaitForSystemPods waits for the kube-system and flux-system pods to be
+// ready. Pods whose name starts with an entry of Config.PendingPodAllowlist
+// may stay pending. On timeout the pods that are still not ready are listed
+// in the error.
+func (k *K8sInstance) WaitForSystemPods(timeout time.Duration) error {
+	return k.waitForPods(systemNamespaces, timeout)
+}
+
+// waitForPods is WaitForSystemPods for the pods of namespaces.
+func (k *K8sInstance) waitForPods(namespaces []string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		notReady, err := k.notReadyPods(namespaces)
+		if err != nil {
+			return err
+		}
+		if len(notReady) == 0 {
+			return nil
+		}
+		if time.Now().Add(podPollInterval).After(deadline) {
+			return fmt.Errorf("system pods not ready after %v: %s", timeout, strings.Join(notReady, ", "))
+		}
+		time.Sleep(podPollInterval)
+	}
+}
+
+func (k *K8sInstance) notReadyPods(namespaces []string) ([]string, error) {
+	var notReady []string
+	for _, ns := range namespaces {
+		pods, err := k.pods(ns)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range pods {
+			if p.ready() || k.podAllowedPending(p.Metadata.Name) {
+				continue
+			}
+			notReady = append(notReady, fmt.Sprintf("%s/%s (%s)", p.Metadata.Namespace, p.Metadata.Name, p.Status.Phase))
+		}
+	}
+	sort.Strings(notReady)
+	return notReady, nil
+}
+
+func (k *K8sInstance) podAllowedPending(name string) bool {
+	for _, prefix := range k.cfg.PendingPodAllowlist {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExecInPod runs cmd in a container of a pod through kubectl exec and
+// returns its stdout. An empty container runs cmd in the default container
+// of the pod.
+func (k *K8sInstance) ExecInPod(namespace, pod, container string, cmd []string) (string, error) {
+	args := []string{"exec", "-n", namespace, pod}
+	if container != "" {
+		args = append(args, "-c", container)
+	}
+	args = append(args, "--")
+	args = append(args, cmd...)
+	for i, arg := range args {
+		args[i] = shellQuote(arg)
+	}
+	res, err := k.exec("exec-"+pod, "kubectl "+strings.Join(args, " "), true)
+	if err != nil {
+		if strings.Contains(res.Stderr, "container not found") || strings.Contains(res.Stderr, "is not valid for pod") {
+			return "", fmt.Errorf("pod %s/%s has no container %s", namespace, pod, container)
+		}
+		return "", fmt.Errorf("failed to exec in %s/%s: %w", namespace, pod, err)
+	}
+	return res.Stdout, nil
+}
@@ -0,0 +1,88 @@
+package k3sflux
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+)
+
+// conftestImage provides the conftest binary EvaluatePolicies runs.
+const conftestImage = "openpolicyagent/conftest:v0.44.1"
+
+// PolicyViolation is a single deny or warn rule that matched.
+type PolicyViolation struct {
+	// Namespace is the rego package of the rule, e.g. main.
+	Namespace string
+	Message   string
+}
+
+// PolicyCheck is an EvaluatePolicies call Run makes.
+type PolicyCheck struct {
+	ManifestsPath string
+	PoliciesPath  string
+}
+
+// PolicyCheckResult is the outcome of a PolicyCheck.
+type PolicyCheckResult struct {
+	PolicyCheck
+	PolicyResult
+}
+
+// PolicyResult is the outcome of EvaluatePolicies.
+type PolicyResult struct {
+	// Violations are the deny and violation rules that matched; any of
+	// them would have the manifests rejected.
+	Violations []PolicyViolation
+	// Warnings are the warn rules that matched.
+	Warnings []PolicyViolation
+}
+
+// Passed reports whether no deny rule matched.
+func (r PolicyResult) Passed() bool {
+	return len(r.Violations) == 0
+}
+
+// EvaluatePolicies renders the kustomization at manifestsPath and evaluates
+// it with conftest against the rego policies at policiesPath, both relative
+// to the cloned repository. Nothing is installed in the cluster, so this
+// runs ahead of ServerDryRunApply as a cheaper gate. Matched rules are
+// returned in the result; the error is only set when conftest could not
+// evaluate the policies.
+func (k *K8sInstance) EvaluatePolicies(manifestsPath, policiesPath string) (PolicyResult, error) {
+	var result PolicyResult
+	if err := k.requireSession("EvaluatePolicies"); err != nil {
+		return result, err
+	}
+	c := k.container.WithFile("/usr/local/bin/conftest", k.from(conftestImage).File("/conftest"))
+	input := shellQuote(path.Join(k.workDir(), "policy-input.yaml"))
+	command := fmt.Sprintf(
+		"kubectl kustomize %s > %s && conftest test --all-namespaces -o json -p %s %s",
+		shellQuote(path.Join(srcDir, manifestsPath)), input, shellQuote(path.Join(srcDir, policiesPath)), input,
+	)
+	res, err := k.execIn(c, "policies", command, false)
+	// conftest exits 1 when a deny rule matched
+	if err != nil && res.ExitCode != 1 {
+		return result, fmt.Errorf("failed to evaluate policies %s on %s: %w", policiesPath, manifestsPath, err)
+	}
+	var files []struct {
+		Namespace string `json:"namespace"`
+		Warnings  []struct {
+			Msg string `json:"msg"`
+		} `json:"warnings"`
+		Failures []struct {
+			Msg string `json:"msg"`
+		} `json:"failures"`
+	}
+	if err := json.Unmarshal([]byte(res.Stdout), &files); err != nil {
+		return result, fmt.Errorf("failed to decode conftest output: %w", err)
+	}
+	for _, f := range files {
+		for _, w := range f.Warnings {
+			result.Warnings = append(result.Warnings, PolicyViolation{Namespace: f.Namespace, Message: w.Msg})
+		}
+		for _, v := range f.Failures {
+			result.Violations = append(result.Violations, PolicyViolation{Namespace: f.Namespace, Message: v.Msg})
+		}
+	}
+	return result, nil
+}
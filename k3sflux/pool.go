@@ -0,0 +1,141 @@
+package k3sflux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// poolKeepNamespaces survive a ClusterPool reset, everything else is deleted.
+var poolKeepNamespaces = map[string]bool{
+	"default":         true,
+	"kube-system":     true,
+	"kube-public":     true,
+	"kube-node-lease": true,
+}
+
+// poolResetTimeout bounds the wait for the namespaces deleted on reset.
+const poolResetTimeout = 5 * time.Minute
+
+// ClusterPool hands out pre-started clusters to test suites, resetting them
+// between uses instead of starting k3s for every case. Clusters come out of
+// the pool started but without flux, tests bootstrap them as needed.
+type ClusterPool struct {
+	ctx      context.Context
+	clusters chan *K8sInstance
+
+	mu    sync.Mutex
+	alive int
+	// retired is closed once the last cluster was retired, waking up the
+	// callers waiting in Acquire.
+	retired chan struct{}
+}
+
+// NewClusterPool starts size clusters from cfg in parallel. Each gets
+// cfg.Name suffixed with its index, and so its own cache volume and service
+// alias. Clusters that fail to start are reported together in the error.
+func NewClusterPool(ctx context.Context, client *dagger.Client, size int, cfg Config) (*ClusterPool, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("cluster pool size must be positive, got %d", size)
+	}
+	p := &ClusterPool{ctx: ctx, clusters: make(chan *K8sInstance, size), alive: size, retired: make(chan struct{})}
+	errs := make([]error, size)
+	var wg sync.WaitGroup
+	for i := 0; i < size; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := cfg
+			c.Name = fmt.Sprintf("%spool-%d", namePrefix(cfg.Name), i)
+			k := newConfiguredInstance(ctx, client, c)
+			if err := k.start(); err != nil {
+				errs[i] = fmt.Errorf("cluster %s: %w", c.Name, err)
+				return
+			}
+			p.clusters <- k
+		}(i)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("failed to start the cluster pool: %w", err)
+	}
+	return p, nil
+}
+
+func namePrefix(name string) string {
+	if name == "" {
+		return ""
+	}
+	return name + "-"
+}
+
+// Acquire waits for a free cluster. It fails once the context is done or
+// every cluster was retired by a failed Release.
+func (p *ClusterPool) Acquire() (*K8sInstance, error) {
+	select {
+	case k := <-p.clusters:
+		return k, nil
+	case <-p.retired:
+		return nil, errors.New("cluster pool has no clusters left")
+	case <-p.ctx.Done():
+		return nil, p.ctx.Err()
+	}
+}
+
+// Release resets a cluster obtained from Acquire and returns it to the pool.
+// A cluster that cannot be reset is restarted from scratch; when that fails
+// too it is retired and the error returned.
+func (p *ClusterPool) Release(k *K8sInstance) error {
+	if err := k.reset(); err != nil {
+		k.warnf("reset of cluster %s failed, restarting it: %v", k.cfg.Name, err)
+		if err := k.start(); err != nil {
+			p.mu.Lock()
+			p.alive--
+			if p.alive == 0 {
+				close(p.retired)
+			}
+			p.mu.Unlock()
+			return fmt.Errorf("failed to restart cluster %s, retiring it: %w", k.cfg.Name, err)
+		}
+	}
+	p.clusters <- k
+	return nil
+}
+
+// reset brings the cluster back to its state after start: flux is
+// uninstalled and every namespace created since is deleted.
+func (k *K8sInstance) reset() error {
+	installed, err := k.fluxInstalled()
+	if err != nil {
+		return err
+	}
+	if installed {
+		if _, err := k.flux("uninstall --silent", true); err != nil {
+			return fmt.Errorf("failed to uninstall flux: %w", err)
+		}
+		k.fluxFound = false
+	}
+	res, err := k.kubectl("get namespaces -o name", true)
+	if err != nil {
+		return fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	var namespaces []string
+	for _, ns := range strings.Fields(res.Stdout) {
+		if !poolKeepNamespaces[strings.TrimPrefix(ns, "namespace/")] {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	if len(namespaces) > 0 {
+		command := fmt.Sprintf("delete %s --ignore-not-found", strings.Join(namespaces, " "))
+		if _, err := k.kubectlDeadline(k.container, command, poolResetTimeout); err != nil {
+			return fmt.Errorf("failed to delete namespaces: %w", err)
+		}
+	}
+	k.warnings = nil
+	return nil
+}
@@ -0,0 +1,138 @@
+package k3sflux
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+const (
+	// prePullNamespace holds the pods PrePullImages runs.
+	prePullNamespace = "kube-system"
+	// prePullTimeout bounds the pulls on each node.
+	prePullTimeout = 15 * time.Minute
+	// containerdSocketDir is where k3s puts the containerd socket on a node.
+	containerdSocketDir = "/run/k3s/containerd"
+)
+
+// prePullPod pulls images with crictl through the containerd socket of the
+// node, so the pulls go through the registries.yaml mirrors like the ones of
+// the kubelet. It prints "pulled <image>" or "failed <image> <error>" per
+// image and never fails itself, the outcome is read from its logs.
+const prePullPod = `apiVersion: v1
+kind: Pod
+metadata:
+  name: %s
+  namespace: ` + prePullNamespace + `
+spec:
+  nodeName: %s
+  restartPolicy: Never
+  tolerations:
+  - operator: Exists
+  containers:
+  - name: crictl
+    image: %s
+    command: ["sh", "-c", %s]
+    env:
+    - name: CONTAINER_RUNTIME_ENDPOINT
+      value: unix://` + containerdSocketDir + `/containerd.sock
+    volumeMounts:
+    - name: containerd
+      mountPath: ` + containerdSocketDir + `
+  volumes:
+  - name: containerd
+    hostPath:
+      path: ` + containerdSocketDir + `
+`
+
+// ImagePullStatus is the outcome of pulling an image onto a node.
+type ImagePullStatus struct {
+	Node  string
+	Image string
+	// Error is the crictl error, empty when the image was pulled.
+	Error string
+}
+
+// PrePullImages pulls images onto every node with crictl, from a pod per
+// node running the k3s image, which ships crictl, and waits for all of
+// them. Combined with the images the manifests reference, it keeps slow
+// pulls from timing out the first reconciliation. Every node and image gets
+// a status; the error lists the images that could not be pulled.
+func (k *K8sInstance) PrePullImages(images []string) ([]ImagePullStatus, error) {
+	if err := k.requireSession("PrePullImages"); err != nil {
+		return nil, err
+	}
+	var nodes struct {
+		Items []node `json:"items"`
+	}
+	if err := k.kubectlJSON("get nodes", &nodes); err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	var script strings.Builder
+	for _, image := range images {
+		fmt.Fprintf(&script, "if out=$(crictl pull %[1]s 2>&1); then echo pulled %[1]s; else echo failed %[1]s $out; fi\n", shellQuote(image))
+	}
+	command, err := json.Marshal(script.String())
+	if err != nil {
+		return nil, err
+	}
+	var manifests []string
+	pods := map[string]string{}
+	for i, n := range nodes.Items {
+		name := fmt.Sprintf("prepull-%d", i)
+		pods[name] = n.Metadata.Name
+		manifests = append(manifests, fmt.Sprintf(prePullPod, name, n.Metadata.Name, k.k3sImage(), command))
+	}
+	file := path.Join(k.workDir(), "prepull.yaml")
+	c := k.container.WithNewFile(file, dagger.ContainerWithNewFileOpts{Contents: strings.Join(manifests, "---\n")})
+	if _, err := k.execIn(c, "pre-pull", "kubectl apply -f "+shellQuote(file), true); err != nil {
+		return nil, fmt.Errorf("failed to create the pre-pull pods: %w", err)
+	}
+	defer func() {
+		if _, err := k.kubectl("delete pods --ignore-not-found -n "+prePullNamespace+" "+strings.Join(sortedKeys(pods), " "), true); err != nil {
+			k.warnf("failed to delete the pre-pull pods: %v", err)
+		}
+	}()
+	var statuses []ImagePullStatus
+	var errs []error
+	for _, name := range sortedKeys(pods) {
+		wait := fmt.Sprintf("pod/%s -n %s --for=jsonpath='{.status.phase}'=Succeeded", name, prePullNamespace)
+		if _, err := k.kubectlWait(k.container, wait, prePullTimeout); err != nil {
+			return statuses, fmt.Errorf("pre-pull on node %s did not complete: %w", pods[name], err)
+		}
+		res, err := k.kubectl(fmt.Sprintf("logs %s -n %s", name, prePullNamespace), true)
+		if err != nil {
+			return statuses, fmt.Errorf("failed to read the pre-pull logs of node %s: %w", pods[name], err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(res.Stdout), "\n") {
+			verdict, rest, _ := strings.Cut(line, " ")
+			image, msg, _ := strings.Cut(rest, " ")
+			switch verdict {
+			case "pulled":
+				statuses = append(statuses, ImagePullStatus{Node: pods[name], Image: image})
+			case "failed":
+				statuses = append(statuses, ImagePullStatus{Node: pods[name], Image: image, Error: msg})
+				errs = append(errs, fmt.Errorf("failed to pull %s on node %s: %s", image, pods[name], msg))
+			}
+		}
+	}
+	return statuses, errors.Join(errs...)
+}
+
+// ImagePullReport lists the statuses one per line.
+func ImagePullReport(statuses []ImagePullStatus) string {
+	var b strings.Builder
+	for _, s := range statuses {
+		if s.Error != "" {
+			fmt.Fprintf(&b, "%s %s: failed: %s\n", s.Node, s.Image, s.Error)
+		} else {
+			fmt.Fprintf(&b, "%s %s: pulled\n", s.Node, s.Image)
+		}
+	}
+	return b.String()
+}
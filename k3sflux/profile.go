@@ -0,0 +1,68 @@
+package k3sflux
+
+import (
+	"fmt"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// FluxResourceProfile selects resource requests for the flux controllers.
+type FluxResourceProfile string
+
+const (
+	// FluxResourceDefault keeps the requests shipped with flux.
+	FluxResourceDefault FluxResourceProfile = ""
+	// FluxResourceMinimal lowers the requests so the controllers schedule on
+	// a tiny single node k3s cluster.
+	FluxResourceMinimal FluxResourceProfile = "minimal"
+)
+
+// minimalProfileKustomization patches every flux controller down to a few
+// millicores and megabytes of requests.
+const minimalProfileKustomization = `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+  - gotk-components.yaml
+  - gotk-sync.yaml
+patches:
+  - target:
+      kind: Deployment
+      labelSelector: app.kubernetes.io/part-of=flux
+    patch: |
+      - op: replace
+        path: /spec/template/spec/containers/0/resources/requests
+        value:
+          cpu: 10m
+          memory: 32Mi
+`
+
+// profileScheduleTimeout bounds the wait for the flux pods to be scheduled
+// once a resource profile was applied.
+const profileScheduleTimeout = 2 * time.Minute
+
+// profileKustomization returns the bootstrap kustomization implementing the
+// profile, or nil for the default profile.
+func (k *K8sInstance) profileKustomization(profile FluxResourceProfile) (*dagger.File, error) {
+	switch profile {
+	case FluxResourceDefault:
+		return nil, nil
+	case FluxResourceMinimal:
+		if err := k.requireSession("profileKustomization"); err != nil {
+			return nil, err
+		}
+		return k.client.Directory().
+			WithNewFile("kustomization.yaml", minimalProfileKustomization).
+			File("kustomization.yaml"), nil
+	default:
+		return nil, fmt.Errorf("unknown flux resource profile %q", profile)
+	}
+}
+
+// assertFluxScheduled checks every flux controller pod got scheduled.
+func (k *K8sInstance) assertFluxScheduled() error {
+	if _, err := k.kubectlWait(k.container, "pods --all -n flux-system --for=condition=PodScheduled", profileScheduleTimeout); err != nil {
+		return fmt.Errorf("flux controllers were not scheduled with the %s resource profile: %w", k.cfg.FluxResourceProfile, err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package k3sflux
+
+import (
+	"fmt"
+	"strings"
+)
+
+// promMetric is a metric family of FormatPrometheus with its samples.
+type promMetric struct {
+	name    string
+	help    string
+	samples []promSample
+}
+
+type promSample struct {
+	labels [][2]string
+	value  float64
+}
+
+// FormatPrometheus renders result in the Prometheus text exposition format,
+// e.g. for a Pushgateway, as gauges describing this one run. Every sample is
+// labeled with the cluster, Config.Name or "default"; the per phase,
+// kustomization and diff samples also carry the phase or the kustomization.
+func FormatPrometheus(result RunResult) string {
+	cluster := result.Cluster
+	if cluster == "" {
+		cluster = "default"
+	}
+	base := [2]string{"cluster", cluster}
+	success, drifted := 1.0, 0.0
+	if result.Failed() {
+		success = 0
+	}
+	for _, d := range result.Diffs {
+		if d.DriftDetected() {
+			drifted++
+		}
+	}
+	metrics := []promMetric{
+		{"gitops_run_success", "Whether the run completed without aborting.", []promSample{{[][2]string{base}, success}}},
+		{"gitops_run_duration_seconds", "Wall time of the run.", []promSample{{[][2]string{base}, result.Finished.Sub(result.Started).Seconds()}}},
+		{"gitops_warnings_total", "Non-fatal problems met during the run.", []promSample{{[][2]string{base}, float64(len(result.Warnings))}}},
+		{"gitops_diff_drift_total", "Diffed kustomizations that would change the cluster.", []promSample{{[][2]string{base}, drifted}}},
+	}
+	duration := promMetric{name: "gitops_phase_duration_seconds", help: "Wall time of each phase of the run."}
+	phaseSuccess := promMetric{name: "gitops_phase_success", help: "Whether each phase of the run succeeded."}
+	for _, p := range result.Phases {
+		labels := [][2]string{base, {"phase", p.Name}}
+		duration.samples = append(duration.samples, promSample{labels, p.Finished.Sub(p.Started).Seconds()})
+		ok := 1.0
+		if p.Error != "" {
+			ok = 0
+		}
+		phaseSuccess.samples = append(phaseSuccess.samples, promSample{labels, ok})
+	}
+	ready := promMetric{name: "gitops_kustomization_ready", help: "Whether each kustomization is Ready."}
+	for _, ks := range result.Kustomizations {
+		value := 0.0
+		if ks.Ready {
+			value = 1
+		}
+		ready.samples = append(ready.samples, promSample{[][2]string{base, {"namespace", ks.Namespace}, {"kustomization", ks.Name}}, value})
+	}
+	changes := promMetric{name: "gitops_diff_changes", help: "Objects each kustomization would create or update."}
+	deletions := promMetric{name: "gitops_diff_deletions", help: "Objects each kustomization would prune."}
+	for _, d := range result.Diffs {
+		labels := [][2]string{base, {"kustomization", d.Kustomization}}
+		changes.samples = append(changes.samples, promSample{labels, float64(len(d.Changes))})
+		deletions.samples = append(deletions.samples, promSample{labels, float64(len(d.Deletions))})
+	}
+	metrics = append(metrics, duration, phaseSuccess, ready, changes, deletions)
+
+	var b strings.Builder
+	for _, m := range metrics {
+		if len(m.samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+		for _, s := range m.samples {
+			pairs := make([]string, len(s.labels))
+			for i, l := range s.labels {
+				pairs[i] = fmt.Sprintf("%s=\"%s\"", l[0], promEscape(l[1]))
+			}
+			fmt.Fprintf(&b, "%s{%s} %g\n", m.name, strings.Join(pairs, ","), s.value)
+		}
+	}
+	return b.String()
+}
+
+// promEscape escapes a label value for the text exposition format.
+var promEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace
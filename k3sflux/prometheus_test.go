@@ -0,0 +1,20 @@
+package k3sflux
+
+import "testing"
+
+func TestFormatPrometheus(t *testing.T) {
+	tests := []struct {
+		name   string
+		result RunResult
+		golden string
+	}{
+		{name: "empty run", golden: "prometheus-empty.golden"},
+		{name: "drift and failed phase", result: goldenRunResult(), golden: "prometheus.golden"},
+		{name: "aborted", result: RunResult{Cluster: `team "a"`, Error: "start failed"}, golden: "prometheus-aborted.golden"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertGolden(t, tt.golden, []byte(FormatPrometheus(tt.result)))
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package k3sflux
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// VerifyPrune checks that flux garbage collects removedResource, an object
+// the kustomization applied before it was removed from git. The kustomization
+// is reconciled with its source through ReconcileAndWait, then the object is
+// polled until it is gone, both within timeout. A kustomization without
+// prune: true is reported right away, since it never deletes anything.
+func (k *K8sInstance) VerifyPrune(kustomization, namespace string, removedResource ResourceRef, timeout time.Duration) error {
+	ks, err := k.kustomization(kustomization, namespace)
+	if err != nil {
+		return err
+	}
+	if !ks.Spec.Prune {
+		return fmt.Errorf("kustomization %s/%s does not set prune: true, %s is never pruned", namespace, kustomization, removedResource)
+	}
+	deadline := time.Now().Add(timeout)
+	if _, err := k.ReconcileAndWait("kustomization", kustomization, namespace, timeout); err != nil {
+		return err
+	}
+	for {
+		o, err := k.liveObject(removedResource)
+		if err != nil {
+			return err
+		}
+		if o == nil {
+			return nil
+		}
+		if time.Now().Add(podPollInterval).After(deadline) {
+			err := fmt.Errorf("%s still exists %v after reconciling kustomization %s/%s", removedResource, timeout, namespace, kustomization)
+			if len(o.Metadata.Finalizers) > 0 {
+				return fmt.Errorf("%w, blocked by finalizers %s", err, strings.Join(o.Metadata.Finalizers, ", "))
+			}
+			return err
+		}
+		time.Sleep(podPollInterval)
+	}
+}
@@ -0,0 +1,103 @@
+package k3sflux
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// persistentVolumeClaim is the subset of a PersistentVolumeClaim WaitForPVCs
+// reads.
+type persistentVolumeClaim struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		StorageClassName *string `json:"storageClassName"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase"`
+	} `json:"status"`
+}
+
+func (pvc persistentVolumeClaim) key() string {
+	return pvc.Metadata.Namespace + "/" + pvc.Metadata.Name
+}
+
+// storageClass is the class the claim asked for, or "default".
+func (pvc persistentVolumeClaim) storageClass() string {
+	if pvc.Spec.StorageClassName == nil {
+		return "default"
+	}
+	return *pvc.Spec.StorageClassName
+}
+
+// event is the subset of a core Event the helpers read.
+type event struct {
+	InvolvedObject struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"involvedObject"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// WaitForPVCs waits for every PersistentVolumeClaim in namespace, or in all
+// namespaces when it is empty, to be Bound. On timeout the claims still
+// pending are listed in the error with their storage class and the last
+// event recorded for them, e.g. ProvisioningFailed for a storage class that
+// does not exist. The k3s local-path class binds only once a pod uses the
+// claim, so an unused claim reports WaitForFirstConsumer.
+func (k *K8sInstance) WaitForPVCs(namespace string, timeout time.Duration) error {
+	scope := "-A"
+	if namespace != "" {
+		scope = "-n " + namespace
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		var list struct {
+			Items []persistentVolumeClaim `json:"items"`
+		}
+		if err := k.kubectlJSON("get persistentvolumeclaims "+scope, &list); err != nil {
+			return fmt.Errorf("failed to list persistentvolumeclaims: %w", err)
+		}
+		var pending []persistentVolumeClaim
+		for _, pvc := range list.Items {
+			if pvc.Status.Phase != "Bound" {
+				pending = append(pending, pvc)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		if time.Now().Add(podPollInterval).After(deadline) {
+			return k.pvcTimeoutError(pending, scope, timeout)
+		}
+		time.Sleep(podPollInterval)
+	}
+}
+
+// pvcTimeoutError describes the claims that did not bind, with the last
+// event of each.
+func (k *K8sInstance) pvcTimeoutError(pending []persistentVolumeClaim, scope string, timeout time.Duration) error {
+	var events struct {
+		Items []event `json:"items"`
+	}
+	last := map[string]event{}
+	if err := k.kubectlJSON("get events --field-selector involvedObject.kind=PersistentVolumeClaim --sort-by=.lastTimestamp "+scope, &events); err != nil {
+		k.warnf("failed to read persistentvolumeclaim events: %v", err)
+	}
+	for _, e := range events.Items {
+		last[e.InvolvedObject.Namespace+"/"+e.InvolvedObject.Name] = e
+	}
+	lines := make([]string, 0, len(pending))
+	for _, pvc := range pending {
+		line := fmt.Sprintf("%s %s (storage class %s)", pvc.key(), pvc.Status.Phase, pvc.storageClass())
+		if e, ok := last[pvc.key()]; ok {
+			line += fmt.Sprintf(": %s: %s", e.Reason, e.Message)
+		}
+		lines = append(lines, line)
+	}
+	return fmt.Errorf("%d persistentvolumeclaim(s) not bound after %v:\n%s", len(pending), timeout, strings.Join(lines, "\n"))
+}
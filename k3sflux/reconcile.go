@@ -0,0 +1,191 @@
+package k3sflux
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ReconcileStatus is the Ready condition of a flux object once
+// ReconcileAndWait is done with it, along with the revisions it applied and
+// attempted and the revision of the artifact of its source.
+type ReconcileStatus struct {
+	Ready             bool
+	Reason            string
+	Message           string
+	AppliedRevision   string
+	AttemptedRevision string
+	SourceRevision    string
+}
+
+// reconcilePollInterval is the pause between two checks of the applied
+// revision in ReconcileAndWait.
+const reconcilePollInterval = time.Second
+
+// ReconcileAndWait triggers a reconciliation of the flux object, including
+// its source, waits for it to be Ready again with the revision of its source
+// applied and returns its final status, also on failure when it could be
+// read. flux reconcile only returns once the controller handled the request,
+// so the wait cannot pass on the state from before the reconciliation, but
+// the object can turn Ready on the previous revision while the new one is
+// still being applied. kind is a flux reconcile kind with a source,
+// kustomization or helmrelease.
+func (k *K8sInstance) ReconcileAndWait(kind, name, namespace string, timeout time.Duration) (ReconcileStatus, error) {
+	_, err := k.flux(fmt.Sprintf("reconcile %s %s -n %s --with-source --timeout=%s", kind, name, namespace, timeout), true)
+	if err != nil {
+		status := k.reconcileStatus(kind, name, namespace)
+		return status, fmt.Errorf("failed to reconcile %s %s/%s: %w%s", kind, namespace, name, err, status.describe())
+	}
+	deadline := time.Now().Add(timeout)
+	_, err = k.kubectlWait(k.container, fmt.Sprintf("%s/%s -n %s --for=condition=ready", kind, name, namespace), timeout)
+	for {
+		status := k.reconcileStatus(kind, name, namespace)
+		if err != nil {
+			return status, fmt.Errorf("%s %s/%s did not become ready: %w%s", kind, namespace, name, err, status.describe())
+		}
+		if status.SourceRevision != "" && status.AppliedRevision == status.SourceRevision {
+			return status, nil
+		}
+		if status.SourceRevision != "" && status.AttemptedRevision == status.SourceRevision {
+			return status, fmt.Errorf("%s %s/%s failed to apply revision %s, last applied revision %q%s", kind, namespace, name, status.SourceRevision, status.AppliedRevision, status.describe())
+		}
+		if time.Now().Add(reconcilePollInterval).After(deadline) {
+			return status, fmt.Errorf("%s %s/%s did not apply revision %q of its source within %v, last applied revision %q", kind, namespace, name, status.SourceRevision, timeout, status.AppliedRevision)
+		}
+		time.Sleep(reconcilePollInterval)
+	}
+}
+
+// reconcileStatus reads the Ready condition and the revisions of an object
+// and of its source, leaving what cannot be read empty. The source of a
+// HelmRelease is the HelmChart the controller created for it.
+func (k *K8sInstance) reconcileStatus(kind, name, namespace string) ReconcileStatus {
+	var o struct {
+		Spec struct {
+			SourceRef struct {
+				Kind      string `json:"kind"`
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"sourceRef"`
+		} `json:"spec"`
+		Status struct {
+			Conditions            []condition `json:"conditions"`
+			LastAppliedRevision   string      `json:"lastAppliedRevision"`
+			LastAttemptedRevision string      `json:"lastAttemptedRevision"`
+			// HelmChart is the namespace/name of the chart of a HelmRelease.
+			HelmChart string `json:"helmChart"`
+		} `json:"status"`
+	}
+	if err := k.kubectlJSON(fmt.Sprintf("get %s/%s -n %s", kind, name, namespace), &o); err != nil {
+		return ReconcileStatus{}
+	}
+	ready := findReady(o.Status.Conditions)
+	status := ReconcileStatus{
+		Ready:             ready.Status == "True",
+		Reason:            ready.Reason,
+		Message:           ready.Message,
+		AppliedRevision:   o.Status.LastAppliedRevision,
+		AttemptedRevision: o.Status.LastAttemptedRevision,
+	}
+	source := o.Spec.SourceRef
+	if chartNamespace, chart, ok := strings.Cut(o.Status.HelmChart, "/"); ok {
+		source.Kind, source.Namespace, source.Name = "HelmChart", chartNamespace, chart
+	}
+	if source.Kind == "" {
+		return status
+	}
+	if source.Namespace == "" {
+		source.Namespace = namespace
+	}
+	var artifact struct {
+		Status struct {
+			Artifact struct {
+				Revision string `json:"revision"`
+			} `json:"artifact"`
+		} `json:"status"`
+	}
+	if err := k.kubectlJSON(fmt.Sprintf("get %s/%s -n %s", source.Kind, source.Name, source.Namespace), &artifact); err == nil {
+		status.SourceRevision = artifact.Status.Artifact.Revision
+	}
+	return status
+}
+
+// describe renders the status for error messages, empty when unknown.
+func (s ReconcileStatus) describe() string {
+	if s.Reason == "" && s.Message == "" {
+		return ""
+	}
+	return fmt.Sprintf("\nstatus: %s: %s", s.Reason, s.Message)
+}
+
+// readyStatus describes the Ready condition of an object for error messages,
+// or returns an empty string when it cannot be read.
+func (k *K8sInstance) readyStatus(kind, name, namespace string) string {
+	res, err := k.kubectl(fmt.Sprintf(`get %s/%s -n %s -o jsonpath='{.status.conditions[?(@.type=="Ready")].reason}: {.status.conditions[?(@.type=="Ready")].message}'`, kind, name, namespace), true)
+	if err != nil || strings.TrimSpace(res.Stdout) == ":" {
+		return ""
+	}
+	return "\nstatus: " + strings.TrimSpace(res.Stdout)
+}
+
+// measureReconcileTimeout bounds each reconciliation MeasureReconcileTime
+// times.
+const measureReconcileTimeout = 10 * time.Minute
+
+// MeasureReconcileTime reconciles the flux object through ReconcileAndWait
+// and returns how long it took until the new revision was applied and the
+// object Ready again, e.g. to catch manifests that slow down apply.
+func (k *K8sInstance) MeasureReconcileTime(kind, name, namespace string) (time.Duration, error) {
+	started := time.Now()
+	if _, err := k.ReconcileAndWait(kind, name, namespace, measureReconcileTimeout); err != nil {
+		return 0, err
+	}
+	return time.Since(started), nil
+}
+
+// ReconcileTiming is the reconciliation time of one Kustomization.
+type ReconcileTiming struct {
+	Name      string
+	Namespace string
+	Duration  time.Duration
+	// Error is empty when the reconciliation succeeded and Duration is set.
+	Error string
+}
+
+// MeasureKustomizations times the reconciliation of every Kustomization in
+// turn, slowest first, for CI trend tracking. A Kustomization that fails to
+// reconcile is reported in its timing without stopping the others.
+func (k *K8sInstance) MeasureKustomizations() ([]ReconcileTiming, error) {
+	items, err := k.kustomizations()
+	if err != nil {
+		return nil, err
+	}
+	timings := make([]ReconcileTiming, 0, len(items))
+	for _, ks := range items {
+		t := ReconcileTiming{Name: ks.Metadata.Name, Namespace: ks.Metadata.Namespace}
+		if t.Duration, err = k.MeasureReconcileTime("kustomization", t.Name, t.Namespace); err != nil {
+			t.Error = err.Error()
+		}
+		timings = append(timings, t)
+	}
+	sort.SliceStable(timings, func(i, j int) bool { return timings[i].Duration > timings[j].Duration })
+	return timings, nil
+}
+
+// ReconcileTimingReport renders the timings one line each, followed by the
+// total time of the successful reconciliations.
+func ReconcileTimingReport(timings []ReconcileTiming) string {
+	var b strings.Builder
+	var total time.Duration
+	for _, t := range timings {
+		if t.Error != "" {
+			fmt.Fprintf(&b, "%s/%s: FAILED: %s\n", t.Namespace, t.Name, t.Error)
+			continue
+		}
+		total += t.Duration
+		fmt.Fprintf(&b, "%s/%s: %v\n", t.Namespace, t.Name, t.Duration.Round(time.Millisecond))
+	}
+	fmt.Fprintf(&b, "total: %v\n", total.Round(time.Millisecond))
+	return b.String()
+}
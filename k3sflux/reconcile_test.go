@@ -0,0 +1,116 @@
+package k3sflux
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconcileAndWait(t *testing.T) {
+	const (
+		reconcile = "flux reconcile kustomization apps -n flux-system --with-source"
+		wait      = "kubectl wait kustomization/apps -n flux-system --for=condition=ready"
+		get       = "kubectl get kustomization/apps -n flux-system -o json"
+		source    = "kubectl get GitRepository/flux-system -n flux-system -o json"
+	)
+	ks := func(applied, attempted string) ExecResult {
+		return ExecResult{Stdout: `{"spec": {"sourceRef": {"kind": "GitRepository", "name": "flux-system"}}, "status": {
+			"conditions": [{"type": "Ready", "status": "True", "reason": "ReconciliationSucceeded", "message": "Applied revision: ` + applied + `"}],
+			"lastAppliedRevision": "` + applied + `", "lastAttemptedRevision": "` + attempted + `"}}`}
+	}
+	artifact := ExecResult{Stdout: `{"status": {"artifact": {"revision": "main@sha1:new"}}}`}
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		steps   []*scriptedStep
+		want    ReconcileStatus
+		polls   int
+		wantErr string
+	}{
+		{
+			name:    "applied",
+			timeout: time.Minute,
+			steps:   []*scriptedStep{step(reconcile), step(wait), step(get, ks("main@sha1:new", "main@sha1:new")), step(source, artifact)},
+			want:    ReconcileStatus{Ready: true, Reason: "ReconciliationSucceeded", Message: "Applied revision: main@sha1:new", AppliedRevision: "main@sha1:new", AttemptedRevision: "main@sha1:new", SourceRevision: "main@sha1:new"},
+			polls:   1,
+		},
+		{
+			name:    "ready before the new revision is applied",
+			timeout: time.Minute,
+			steps:   []*scriptedStep{step(reconcile), step(wait), step(get, ks("main@sha1:old", "main@sha1:old"), ks("main@sha1:new", "main@sha1:new")), step(source, artifact)},
+			want:    ReconcileStatus{Ready: true, Reason: "ReconciliationSucceeded", Message: "Applied revision: main@sha1:new", AppliedRevision: "main@sha1:new", AttemptedRevision: "main@sha1:new", SourceRevision: "main@sha1:new"},
+			polls:   2,
+		},
+		{
+			name:    "new revision not applied in time",
+			timeout: time.Nanosecond,
+			steps:   []*scriptedStep{step(reconcile), step(wait), step(get, ks("main@sha1:old", "main@sha1:old")), step(source, artifact)},
+			want:    ReconcileStatus{Ready: true, Reason: "ReconciliationSucceeded", Message: "Applied revision: main@sha1:old", AppliedRevision: "main@sha1:old", AttemptedRevision: "main@sha1:old", SourceRevision: "main@sha1:new"},
+			polls:   1,
+			wantErr: `did not apply revision "main@sha1:new" of its source within 1ns, last applied revision "main@sha1:old"`,
+		},
+		{
+			name:    "new revision failed to apply",
+			timeout: time.Minute,
+			steps:   []*scriptedStep{step(reconcile), step(wait), step(get, ks("main@sha1:old", "main@sha1:new")), step(source, artifact)},
+			want:    ReconcileStatus{Ready: true, Reason: "ReconciliationSucceeded", Message: "Applied revision: main@sha1:old", AppliedRevision: "main@sha1:old", AttemptedRevision: "main@sha1:new", SourceRevision: "main@sha1:new"},
+			polls:   1,
+			wantErr: `failed to apply revision main@sha1:new, last applied revision "main@sha1:old"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := script(tt.steps...)
+			status, err := NewOfflineInstance(context.Background(), Config{}, e).ReconcileAndWait("kustomization", "apps", "flux-system", tt.timeout)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ReconcileAndWait() error = %v, want %q", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(status, tt.want) {
+				t.Errorf("status = %+v, want %+v", status, tt.want)
+			}
+			if got := e.count(get); got != tt.polls {
+				t.Errorf("read the status %d times, want %d", got, tt.polls)
+			}
+		})
+	}
+}
+
+func TestReconcileAndWaitHelmRelease(t *testing.T) {
+	k := offline(Config{}, RecordedExecutor{
+		"flux reconcile helmrelease web -n apps --with-source --timeout=1m0s":       {},
+		"kubectl wait helmrelease/web -n apps --for=condition=ready --timeout=1m0s": {},
+		"kubectl get helmrelease/web -n apps -o json":                               {Stdout: `{"status": {"conditions": [{"type": "Ready", "status": "True"}], "lastAppliedRevision": "6.3.5", "lastAttemptedRevision": "6.3.5", "helmChart": "flux-system/apps-web"}}`},
+		"kubectl get HelmChart/apps-web -n flux-system -o json":                     {Stdout: `{"status": {"artifact": {"revision": "6.3.5"}}}`},
+	})
+	status, err := k.ReconcileAndWait("helmrelease", "web", "apps", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.SourceRevision != "6.3.5" || status.AppliedRevision != "6.3.5" {
+		t.Errorf("status = %+v, want chart 6.3.5 applied", status)
+	}
+}
+
+func TestReconcileAndWaitFailure(t *testing.T) {
+	k := offline(Config{}, RecordedExecutor{
+		"flux reconcile kustomization apps -n flux-system --with-source --timeout=1m0s": {Stderr: "✗ Kustomization reconciliation failed", ExitCode: 1},
+		"kubectl get kustomization/apps -n flux-system -o json": {Stdout: `{"spec": {"sourceRef": {"kind": "GitRepository", "name": "flux-system"}}, "status": {
+			"conditions": [{"type": "Ready", "status": "False", "reason": "BuildFailed", "message": "kustomize build failed"}],
+			"lastAppliedRevision": "main@sha1:old", "lastAttemptedRevision": "main@sha1:new"}}`},
+		"kubectl get GitRepository/flux-system -n flux-system -o json": {Stdout: `{"status": {"artifact": {"revision": "main@sha1:new"}}}`},
+	})
+	status, err := k.ReconcileAndWait("kustomization", "apps", "flux-system", time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "status: BuildFailed: kustomize build failed") {
+		t.Fatalf("ReconcileAndWait() error = %v, want the Ready condition", err)
+	}
+	want := ReconcileStatus{Reason: "BuildFailed", Message: "kustomize build failed", AppliedRevision: "main@sha1:old", AttemptedRevision: "main@sha1:new", SourceRevision: "main@sha1:new"}
+	if status != want {
+		t.Errorf("status = %+v, want %+v", status, want)
+	}
+}
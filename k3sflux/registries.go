@@ -0,0 +1,147 @@
+package k3sflux
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// registriesPath is where the k3s registries.yaml is written. It lives outside
+// the /etc/rancher/k3s cache mount and is handed to k3s via --private-registry.
+const registriesPath = "/etc/rancher/registries.yaml"
+
+// registryCADir is where WithRegistryTLS writes the CA certificates next to
+// registries.yaml.
+const registryCADir = "/etc/rancher/registry-ca"
+
+// registriesConfig is the content of the k3s registries.yaml file.
+type registriesConfig struct {
+	// mirrors maps an upstream registry host to its mirror endpoints.
+	mirrors map[string][]string
+	// configs maps a registry host to the TLS settings containerd uses to
+	// reach it.
+	configs map[string]registryTLS
+}
+
+// registryTLS is the tls block of a registries.yaml configs entry.
+type registryTLS struct {
+	// caCert is the PEM content of the CA, empty to use the system roots.
+	caCert             string
+	insecureSkipVerify bool
+}
+
+// caFile is where the CA of host is written in the k3s container.
+func caFile(host string) string {
+	return path.Join(registryCADir, strings.ReplaceAll(host, ":", "_")+".crt")
+}
+
+func (r registriesConfig) empty() bool {
+	return len(r.mirrors) == 0 && len(r.configs) == 0
+}
+
+// yaml renders the config in the format k3s expects, see
+// https://docs.k3s.io/installation/private-registry
+func (r registriesConfig) yaml() string {
+	var b strings.Builder
+	if len(r.mirrors) > 0 {
+		b.WriteString("mirrors:\n")
+		for _, upstream := range sortedKeys(r.mirrors) {
+			fmt.Fprintf(&b, "  %q:\n    endpoint:\n", upstream)
+			for _, endpoint := range r.mirrors[upstream] {
+				fmt.Fprintf(&b, "      - %q\n", endpoint)
+			}
+		}
+	}
+	if len(r.configs) > 0 {
+		b.WriteString("configs:\n")
+		for _, host := range sortedKeys(r.configs) {
+			tls := r.configs[host]
+			fmt.Fprintf(&b, "  %q:\n    tls:\n", host)
+			if tls.caCert != "" {
+				fmt.Fprintf(&b, "      ca_file: %q\n", caFile(host))
+			}
+			fmt.Fprintf(&b, "      insecure_skip_verify: %t\n", tls.insecureSkipVerify)
+		}
+	}
+	return b.String()
+}
+
+// WithRegistryMirror makes k3s pull images for the upstream registry host
+// (e.g. docker.io) through mirror, a http(s) URL such as a pull-through
+// cache. Mirrors are tried in the order they are added. It must be called
+// before start; invalid arguments are reported by start.
+func (k *K8sInstance) WithRegistryMirror(upstream, mirror string) *K8sInstance {
+	if err := validateRegistryHost(upstream); err != nil {
+		k.setErr(fmt.Errorf("invalid mirror upstream: %w", err))
+		return k
+	}
+	u, err := url.Parse(mirror)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		k.setErr(fmt.Errorf("invalid mirror %q: expected a http(s) URL", mirror))
+		return k
+	}
+	if k.registries.mirrors == nil {
+		k.registries.mirrors = map[string][]string{}
+	}
+	k.registries.mirrors[upstream] = append(k.registries.mirrors[upstream], mirror)
+	return k
+}
+
+// WithRegistryTLS sets how containerd verifies the TLS certificate of the
+// registry host, typically the host of a mirror passed to
+// WithRegistryMirror: caFile, when not empty, is a PEM file on the host
+// holding the CA that signed it, and insecureSkipVerify turns verification
+// off altogether. It must be called before start; a missing or invalid CA
+// file is reported by start.
+func (k *K8sInstance) WithRegistryTLS(host, caFile string, insecureSkipVerify bool) *K8sInstance {
+	if err := validateRegistryHost(host); err != nil {
+		k.setErr(fmt.Errorf("invalid registry TLS host: %w", err))
+		return k
+	}
+	tls := registryTLS{insecureSkipVerify: insecureSkipVerify}
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			k.setErr(fmt.Errorf("failed to read registry CA: %w", err))
+			return k
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(data) {
+			k.setErr(fmt.Errorf("registry CA %s holds no PEM certificate", caFile))
+			return k
+		}
+		tls.caCert = string(data)
+	}
+	if k.registries.configs == nil {
+		k.registries.configs = map[string]registryTLS{}
+	}
+	k.registries.configs[host] = tls
+	return k
+}
+
+// validateRegistryHost accepts registry hosts as containerd names them:
+// host[:port] without scheme or path, or "*" for every registry.
+func validateRegistryHost(host string) error {
+	if host == "*" {
+		return nil
+	}
+	if host == "" || strings.Contains(host, "/") {
+		return fmt.Errorf("%q is not a registry host", host)
+	}
+	if _, err := url.Parse("https://" + host); err != nil {
+		return fmt.Errorf("%q is not a registry host: %w", host, err)
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
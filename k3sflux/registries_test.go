@@ -0,0 +1,160 @@
+package k3sflux
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRegistriesYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		r    registriesConfig
+		want string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "mirrors",
+			r: registriesConfig{mirrors: map[string][]string{
+				"quay.io":   {"https://quay-cache.internal"},
+				"docker.io": {"https://cache.internal:5000", "http://fallback.internal"},
+			}},
+			want: `mirrors:
+  "docker.io":
+    endpoint:
+      - "https://cache.internal:5000"
+      - "http://fallback.internal"
+  "quay.io":
+    endpoint:
+      - "https://quay-cache.internal"
+`,
+		},
+		{
+			name: "mirror behind a private CA",
+			r: registriesConfig{
+				mirrors: map[string][]string{"docker.io": {"https://cache.internal:5000"}},
+				configs: map[string]registryTLS{
+					"cache.internal:5000": {caCert: "-----BEGIN CERTIFICATE-----"},
+					"legacy.internal":     {insecureSkipVerify: true},
+				},
+			},
+			want: `mirrors:
+  "docker.io":
+    endpoint:
+      - "https://cache.internal:5000"
+configs:
+  "cache.internal:5000":
+    tls:
+      ca_file: "/etc/rancher/registry-ca/cache.internal_5000.crt"
+      insecure_skip_verify: false
+  "legacy.internal":
+    tls:
+      insecure_skip_verify: true
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.yaml(); got != tt.want {
+				t.Errorf("yaml() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithRegistryMirror(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream string
+		mirror   string
+		wantErr  bool
+	}{
+		{name: "valid", upstream: "docker.io", mirror: "https://cache.internal:5000"},
+		{name: "every registry", upstream: "*", mirror: "http://cache.internal"},
+		{name: "upstream with scheme", upstream: "https://docker.io", mirror: "https://cache.internal", wantErr: true},
+		{name: "mirror without scheme", upstream: "docker.io", mirror: "cache.internal:5000", wantErr: true},
+		{name: "mirror with other scheme", upstream: "docker.io", mirror: "oci://cache.internal", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := NewOfflineInstance(context.Background(), Config{}, RecordedExecutor{}).WithRegistryMirror(tt.upstream, tt.mirror)
+			if (k.err != nil) != tt.wantErr {
+				t.Fatalf("WithRegistryMirror(%q, %q) error = %v, want error %v", tt.upstream, tt.mirror, k.err, tt.wantErr)
+			}
+			if !tt.wantErr && k.registries.mirrors[tt.upstream][0] != tt.mirror {
+				t.Errorf("mirrors = %v", k.registries.mirrors)
+			}
+		})
+	}
+}
+
+func TestWithRegistryTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(ca, testCertificate(t), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	notPEM := filepath.Join(dir, "ca.txt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		host    string
+		caFile  string
+		wantErr bool
+	}{
+		{name: "private CA", host: "cache.internal:5000", caFile: ca},
+		{name: "skip verify only", host: "cache.internal"},
+		{name: "host with path", host: "cache.internal/v2", wantErr: true},
+		{name: "missing CA", host: "cache.internal", caFile: filepath.Join(dir, "missing.crt"), wantErr: true},
+		{name: "CA without certificate", host: "cache.internal", caFile: notPEM, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := NewOfflineInstance(context.Background(), Config{}, RecordedExecutor{}).WithRegistryTLS(tt.host, tt.caFile, true)
+			if (k.err != nil) != tt.wantErr {
+				t.Fatalf("WithRegistryTLS(%q, %q) error = %v, want error %v", tt.host, tt.caFile, k.err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			tls := k.registries.configs[tt.host]
+			if !tls.insecureSkipVerify || (tls.caCert != "") != (tt.caFile != "") {
+				t.Errorf("configs[%q] = %+v", tt.host, tls)
+			}
+		})
+	}
+}
+
+// testCertificate returns a self-signed PEM certificate.
+func testCertificate(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "registry CA"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
@@ -0,0 +1,154 @@
+package k3sflux
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// OutputFormat is how the command prints the result of a run.
+type OutputFormat int
+
+const (
+	// OutputText prints the listings and logs for humans.
+	OutputText OutputFormat = iota
+	// OutputJSON prints the RunReport as JSON.
+	OutputJSON
+	// OutputSARIF prints FormatSARIF.
+	OutputSARIF
+	// OutputPrometheus prints FormatPrometheus.
+	OutputPrometheus
+)
+
+// RunReport is the JSON summary of a run for CI, built by NewRunReport.
+type RunReport struct {
+	Success        bool                `json:"success"`
+	Error          string              `json:"error,omitempty"`
+	Started        time.Time           `json:"started"`
+	Finished       time.Time           `json:"finished"`
+	Nodes          []NodeReport        `json:"nodes"`
+	Kustomizations []ReadinessReport   `json:"kustomizations"`
+	HelmReleases   []HelmReleaseReport `json:"helmReleases"`
+	Diffs          []DiffReport        `json:"diffs"`
+	Warnings       []string            `json:"warnings"`
+}
+
+// NodeReport is a node of RunReport.
+type NodeReport struct {
+	Name  string `json:"name"`
+	Ready bool   `json:"ready"`
+}
+
+// ReadinessReport is a kustomization of RunReport.
+type ReadinessReport struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Ready     bool   `json:"ready"`
+	Reason    string `json:"reason,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// HelmReleaseReport is a HelmRelease of RunReport.
+type HelmReleaseReport struct {
+	ReadinessReport
+	ChartVersion string `json:"chartVersion,omitempty"`
+}
+
+// DiffReport is a diffed kustomization of RunReport. ExitCode is null and
+// Error set when the kustomization could not be diffed.
+type DiffReport struct {
+	Name      string `json:"name"`
+	Path      string `json:"path,omitempty"`
+	Changed   bool   `json:"changed"`
+	ExitCode  *int   `json:"exitCode"`
+	Changes   int    `json:"changes"`
+	Deletions int    `json:"deletions"`
+	Error     string `json:"error,omitempty"`
+}
+
+// NewRunReport summarizes result, Success being whether the run exits 0
+// under cfg, e.g. false on drift with Config.FailOnDiff.
+func NewRunReport(result *RunResult, cfg Config) RunReport {
+	report := RunReport{
+		Success:        result.ExitCode(cfg) == 0,
+		Error:          result.Error,
+		Started:        result.Started,
+		Finished:       result.Finished,
+		Nodes:          []NodeReport{},
+		Kustomizations: []ReadinessReport{},
+		HelmReleases:   []HelmReleaseReport{},
+		Diffs:          []DiffReport{},
+		Warnings:       append([]string{}, result.Warnings...),
+	}
+	for _, n := range result.NodeReadiness {
+		report.Nodes = append(report.Nodes, NodeReport{Name: n.Name, Ready: n.Ready})
+	}
+	for _, ks := range result.Kustomizations {
+		report.Kustomizations = append(report.Kustomizations, ReadinessReport{
+			Name: ks.Name, Namespace: ks.Namespace, Ready: ks.Ready, Reason: ks.Reason, Message: ks.Message,
+		})
+	}
+	for _, hr := range result.HelmReleases {
+		report.HelmReleases = append(report.HelmReleases, HelmReleaseReport{
+			ReadinessReport: ReadinessReport{Name: hr.Name, Namespace: hr.Namespace, Ready: hr.Ready, Reason: hr.Reason, Message: hr.Message},
+			ChartVersion:    hr.ChartVersion,
+		})
+	}
+	// the diff phases are in target order, the diffs only hold the ones
+	// that succeeded
+	diffs := result.Diffs
+	for _, p := range result.Phases {
+		name, ok := strings.CutPrefix(p.Name, "diff ")
+		if !ok {
+			continue
+		}
+		if p.Error != "" || len(diffs) == 0 {
+			report.Diffs = append(report.Diffs, DiffReport{Name: name, Error: p.Error})
+			continue
+		}
+		d := diffs[0]
+		diffs = diffs[1:]
+		exitCode := d.ExitCode
+		report.Diffs = append(report.Diffs, DiffReport{
+			Name:      d.Kustomization,
+			Path:      d.Path,
+			Changed:   d.DriftDetected(),
+			ExitCode:  &exitCode,
+			Changes:   len(d.Changes),
+			Deletions: len(d.Deletions),
+		})
+	}
+	return report
+}
+
+// collectReadiness records the Ready condition of the nodes and
+// HelmReleases in r.
+func (k *K8sInstance) collectReadiness(r *RunResult) error {
+	var nodes struct {
+		Items []node `json:"items"`
+	}
+	if err := k.kubectlJSON("get nodes", &nodes); err != nil {
+		return fmt.Errorf("failed to list nodes: %w", err)
+	}
+	for _, n := range nodes.Items {
+		r.NodeReadiness = append(r.NodeReadiness, NodeReadiness{Name: n.Metadata.Name, Ready: n.ready()})
+	}
+	var releases struct {
+		Items []helmRelease `json:"items"`
+	}
+	if err := k.kubectlJSON("get helmreleases.helm.toolkit.fluxcd.io -A", &releases); err != nil {
+		return fmt.Errorf("failed to list helmreleases: %w", err)
+	}
+	for _, hr := range releases.Items {
+		ready := findReady(hr.Status.Conditions)
+		r.HelmReleases = append(r.HelmReleases, HelmReleaseReadiness{
+			Name:         hr.Metadata.Name,
+			Namespace:    hr.Metadata.Namespace,
+			ChartVersion: hr.chartVersion(),
+			Ready:        ready.Status == "True",
+			Reason:       ready.Reason,
+			Message:      ready.Message,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package k3sflux
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// object is the subset of any Kubernetes object the listing helpers need.
+type object struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		Annotations map[string]string `json:"annotations"`
+		Finalizers  []string          `json:"finalizers"`
+		// OwnerReferences is only checked for presence.
+		OwnerReferences []struct{} `json:"ownerReferences"`
+	} `json:"metadata"`
+}
+
+// gvk identifies the object type as apiVersion/Kind, e.g. apps/v1/Deployment.
+func (o object) gvk() string {
+	return o.APIVersion + "/" + o.Kind
+}
+
+// liveObject fetches the object ref points to, returning nil when it does
+// not exist.
+func (k *K8sInstance) liveObject(ref ResourceRef) (*object, error) {
+	command := "get " + ref.Kind + "/" + ref.Name + " --ignore-not-found"
+	if ref.Namespace != "" {
+		command += " -n " + ref.Namespace
+	}
+	res, err := k.kubectl(command+" -o json", true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", ref, err)
+	}
+	if strings.TrimSpace(res.Stdout) == "" {
+		return nil, nil
+	}
+	var o object
+	if err := json.Unmarshal([]byte(res.Stdout), &o); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", ref, err)
+	}
+	return &o, nil
+}
+
+// liveObjects lists every listable namespaced object in the namespaces.
+func (k *K8sInstance) liveObjects(namespaces []string) ([]object, error) {
+	res, err := k.kubectl("api-resources --verbs=list --namespaced -o name", true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover resource types: %w", err)
+	}
+	kinds := strings.Join(strings.Fields(res.Stdout), ",")
+	var objects []object
+	for _, ns := range namespaces {
+		var list struct {
+			Items []object `json:"items"`
+		}
+		if err := k.kubectlJSON(fmt.Sprintf("get %s -n %s --ignore-not-found", kinds, ns), &list); err != nil {
+			return nil, fmt.Errorf("failed to list objects in %s: %w", ns, err)
+		}
+		objects = append(objects, list.Items...)
+	}
+	return objects, nil
+}
+
+// ResourceCounts counts the objects in the namespaces per apiVersion/Kind.
+func (k *K8sInstance) ResourceCounts(namespaces []string) (map[string]int, error) {
+	objects, err := k.liveObjects(namespaces)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for _, o := range objects {
+		counts[o.gvk()]++
+	}
+	return counts, nil
+}
+
+// DiffCounts returns how much each count changed between two ResourceCounts
+// snapshots, leaving out the unchanged types. A negative delta means objects
+// were removed.
+func DiffCounts(before, after map[string]int) map[string]int {
+	delta := map[string]int{}
+	for gvk, n := range after {
+		if d := n - before[gvk]; d != 0 {
+			delta[gvk] = d
+		}
+	}
+	for gvk, n := range before {
+		if _, ok := after[gvk]; !ok {
+			delta[gvk] = -n
+		}
+	}
+	return delta
+}
+
+// Explain returns the schema of resource as served by the cluster, e.g.
+// deployment.spec.template or kustomizations.kustomize.toolkit.fluxcd.io,
+// to check manifest fields against the API version actually running.
+func (k *K8sInstance) Explain(resource string) (string, error) {
+	res, err := k.kubectl("explain --recursive "+shellQuote(resource), true)
+	if err != nil {
+		return "", fmt.Errorf("failed to explain %s: %w", resource, err)
+	}
+	return res.Stdout, nil
+}
@@ -0,0 +1,58 @@
+package k3sflux
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestDiffCounts(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after map[string]int
+		want          map[string]int
+	}{
+		{
+			name:   "unchanged",
+			before: map[string]int{"v1/ConfigMap": 2},
+			after:  map[string]int{"v1/ConfigMap": 2},
+			want:   map[string]int{},
+		},
+		{
+			name:   "added and removed",
+			before: map[string]int{"v1/ConfigMap": 2, "apps/v1/Deployment": 3, "v1/Secret": 1},
+			after:  map[string]int{"v1/ConfigMap": 2, "apps/v1/Deployment": 1, "batch/v1/Job": 4},
+			want:   map[string]int{"apps/v1/Deployment": -2, "batch/v1/Job": 4, "v1/Secret": -1},
+		},
+		{
+			name:  "from nothing",
+			after: map[string]int{"v1/Service": 1},
+			want:  map[string]int{"v1/Service": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DiffCounts(tt.before, tt.after); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DiffCounts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResourceCounts(t *testing.T) {
+	k := NewOfflineInstance(context.Background(), Config{}, RecordedExecutor{
+		"kubectl api-resources --verbs=list --namespaced -o name": {Stdout: "configmaps\ndeployments.apps\n"},
+		"kubectl get configmaps,deployments.apps -n apps --ignore-not-found -o json": {Stdout: `{"items": [
+			{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "a"}},
+			{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "b"}},
+			{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": {"name": "web"}}
+		]}`},
+	})
+	counts, err := k.ResourceCounts([]string{"apps"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"v1/ConfigMap": 2, "apps/v1/Deployment": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("ResourceCounts() = %v, want %v", counts, want)
+	}
+}
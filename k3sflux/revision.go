@@ -0,0 +1,120 @@
+package k3sflux
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// revisionSHA extracts the commit from a flux revision, formatted as
+// main@sha1:<sha> since flux 2.0 and main/<sha> before.
+func revisionSHA(revision string) string {
+	if i := strings.LastIndex(revision, "sha1:"); i >= 0 {
+		return revision[i+len("sha1:"):]
+	}
+	if i := strings.LastIndex(revision, "/"); i >= 0 {
+		return revision[i+1:]
+	}
+	return revision
+}
+
+// stripFluxMetadata filters the labels and annotations flux sets on the
+// objects it applies out of a kustomize render. kustomize prints every
+// metadata entry on its own line, so dropping the lines is enough and keeps
+// the output YAML; a labels or annotations map left empty renders as null on
+// both sides alike.
+const stripFluxMetadata = `sed -E '/^ +"?(kustomize|helm)\.toolkit\.fluxcd\.io\/[^:]*:/d'`
+
+// DiffAgainstApplied compares the rendered manifests of the target at the
+// cloned head with the ones at the revision flux last applied for the
+// Kustomization, as a unified diff. Unlike Diff it does not look at the live
+// objects, so it shows what the branch introduces independently of any
+// manual drift in the cluster. An empty string means the renders match.
+func (k *K8sInstance) DiffAgainstApplied(target DiffTarget) (string, error) {
+	namespace := target.Namespace
+	if namespace == "" {
+		namespace = "flux-system"
+	}
+	ks, err := k.kustomization(target.Name, namespace)
+	if err != nil {
+		return "", err
+	}
+	revision := ks.Status.LastAppliedRevision
+	if revision == "" {
+		return "", fmt.Errorf("kustomization %s has not applied a revision yet", ks.key())
+	}
+	sha := revisionSHA(revision)
+
+	normalize := ""
+	if k.cfg.StripFluxMetadata {
+		normalize = " | " + stripFluxMetadata
+	}
+	clone := path.Join(k.workDir(), "applied")
+	applied, head := clone+".yaml", path.Join(k.workDir(), "head.yaml")
+	command := strings.Join([]string{
+		"rm -rf " + shellQuote(clone),
+		fmt.Sprintf("git clone -q %s %s", k.repoShellURL(), shellQuote(clone)),
+		fmt.Sprintf("git -C %s checkout -q %s", shellQuote(clone), shellQuote(sha)),
+		fmt.Sprintf("kubectl kustomize %s%s > %s", shellQuote(target.sourcePathIn(clone)), normalize, shellQuote(applied)),
+		fmt.Sprintf("kubectl kustomize %s%s > %s", shellQuote(target.sourcePath()), normalize, shellQuote(head)),
+		fmt.Sprintf("diff -u -L applied@%s -L head %s %s", sha, shellQuote(applied), shellQuote(head)),
+	}, " && ")
+	res, err := k.exec("diff-applied-"+target.Name, command, false)
+	if err != nil {
+		// diff exits 1 when the renders differ
+		if res.ExitCode == 1 && res.Stdout != "" {
+			return res.Stdout, nil
+		}
+		return "", fmt.Errorf("failed to diff %s against applied revision %s: %w", target.Name, revision, err)
+	}
+	return res.Stdout, nil
+}
+
+// syncPollInterval is the pause between two WaitForSync checks.
+const syncPollInterval = 5 * time.Second
+
+// SyncTimeoutError is returned by WaitForSync when flux did not apply the
+// expected revision in time.
+type SyncTimeoutError struct {
+	Expected     string
+	LastObserved string
+	Timeout      time.Duration
+}
+
+func (e *SyncTimeoutError) Error() string {
+	return fmt.Sprintf("flux did not apply revision %s within %v, last applied revision %q", e.Expected, e.Timeout, e.LastObserved)
+}
+
+// minRevisionLength is the length of the shortest commit SHA WaitForSync
+// accepts, the default length of abbreviated SHAs in git.
+const minRevisionLength = 7
+
+// WaitForSync asks flux to fetch the flux-system source and waits until the
+// root Kustomization applied expectedRevision, a full or abbreviated commit
+// SHA, e.g. the one just pushed to the repository.
+func (k *K8sInstance) WaitForSync(expectedRevision string, timeout time.Duration) error {
+	if len(expectedRevision) < minRevisionLength {
+		return fmt.Errorf("expected revision %q is shorter than %d characters, pass the commit SHA", expectedRevision, minRevisionLength)
+	}
+	if _, err := k.flux("reconcile source git flux-system -n flux-system", true); err != nil {
+		return fmt.Errorf("failed to reconcile the flux-system source: %w", err)
+	}
+	namespace, name, _ := strings.Cut(rootKustomization, "/")
+	deadline := time.Now().Add(timeout)
+	var last string
+	for {
+		ks, err := k.kustomization(name, namespace)
+		if err != nil {
+			return err
+		}
+		last = ks.Status.LastAppliedRevision
+		if last != "" && strings.HasPrefix(revisionSHA(last), expectedRevision) {
+			return nil
+		}
+		if time.Now().Add(syncPollInterval).After(deadline) {
+			return &SyncTimeoutError{Expected: expectedRevision, LastObserved: last, Timeout: timeout}
+		}
+		time.Sleep(syncPollInterval)
+	}
+}
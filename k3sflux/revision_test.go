@@ -0,0 +1,107 @@
+package k3sflux
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// renderExecutor answers the kustomize renders it finds in a command with
+// diff, and every other command from recorded.
+type renderExecutor struct {
+	recorded RecordedExecutor
+	diff     ExecResult
+	commands []string
+}
+
+func (e *renderExecutor) Exec(ctx context.Context, c *dagger.Container, name, command string, cacheBust bool) (ExecResult, error) {
+	if !strings.Contains(command, "kubectl kustomize") {
+		return e.recorded.Exec(ctx, c, name, command, cacheBust)
+	}
+	e.commands = append(e.commands, command)
+	return e.diff, &CommandError{Command: command, ExecResult: e.diff}
+}
+
+func TestRevisionSHA(t *testing.T) {
+	tests := []struct {
+		revision string
+		want     string
+	}{
+		{"main@sha1:5f8c0d2e", "5f8c0d2e"},
+		{"feature/login@sha1:5f8c0d2e", "5f8c0d2e"},
+		{"main/5f8c0d2e", "5f8c0d2e"},
+		{"5f8c0d2e", "5f8c0d2e"},
+	}
+	for _, tt := range tests {
+		if got := revisionSHA(tt.revision); got != tt.want {
+			t.Errorf("revisionSHA(%q) = %q, want %q", tt.revision, got, tt.want)
+		}
+	}
+}
+
+func TestDiffAgainstAppliedStripFluxMetadata(t *testing.T) {
+	for _, strip := range []bool{false, true} {
+		e := &renderExecutor{
+			recorded: RecordedExecutor{
+				fluxCRDLookup: {Stdout: fluxCRDFound},
+				"kubectl get kustomizations.kustomize.toolkit.fluxcd.io apps -n flux-system -o json": {
+					Stdout: `{"metadata": {"name": "apps", "namespace": "flux-system"}, "status": {"lastAppliedRevision": "main@sha1:5f8c0d2e"}}`,
+				},
+			},
+			diff: ExecResult{Stdout: "--- applied@5f8c0d2e\n+++ head\n", ExitCode: 1},
+		}
+		k := NewOfflineInstance(context.Background(), Config{StripFluxMetadata: strip}, e)
+		out, err := k.DiffAgainstApplied(DiffTarget{Name: "apps", Path: "apps"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != e.diff.Stdout {
+			t.Errorf("DiffAgainstApplied() = %q, want %q", out, e.diff.Stdout)
+		}
+		if len(e.commands) != 1 {
+			t.Fatalf("ran %d diff commands, want 1", len(e.commands))
+		}
+		// both the applied and the head render are filtered
+		want := 0
+		if strip {
+			want = 2
+		}
+		if got := strings.Count(e.commands[0], "| "+stripFluxMetadata); got != want {
+			t.Errorf("StripFluxMetadata=%v filters %d renders in %q, want %d", strip, got, e.commands[0], want)
+		}
+	}
+}
+
+func TestWaitForSync(t *testing.T) {
+	const get = "kubectl get kustomizations.kustomize.toolkit.fluxcd.io flux-system -n flux-system -o json"
+	applied := ExecResult{Stdout: `{"metadata": {"name": "flux-system", "namespace": "flux-system"}, "status": {"lastAppliedRevision": "main@sha1:5f8c0d2e9a1b"}}`}
+	tests := []struct {
+		name     string
+		revision string
+		wantErr  string
+	}{
+		{name: "full SHA", revision: "5f8c0d2e9a1b"},
+		{name: "abbreviated SHA", revision: "5f8c0d2"},
+		{name: "other revision", revision: "0a1b2c3d", wantErr: "flux did not apply revision 0a1b2c3d"},
+		{name: "empty", wantErr: `expected revision "" is shorter than 7 characters`},
+		{name: "too short", revision: "5f8c", wantErr: `expected revision "5f8c" is shorter than 7 characters`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := script(step("flux reconcile source git flux-system"), step(fluxCRDLookup, ExecResult{Stdout: fluxCRDFound}), step(get, applied))
+			err := NewOfflineInstance(context.Background(), Config{}, e).WaitForSync(tt.revision, time.Nanosecond)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("WaitForSync() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
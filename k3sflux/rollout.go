@@ -0,0 +1,22 @@
+package k3sflux
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// WaitForRollout waits for a Deployment rollout to complete, surfacing crash
+// loops and image pull failures a Ready Kustomization can hide. On failure
+// the Deployment conditions are included in the error.
+func (k *K8sInstance) WaitForRollout(namespace, deployment string, timeout time.Duration) error {
+	_, err := k.kubectlDeadline(k.container, fmt.Sprintf("rollout status deployment/%s -n %s", deployment, namespace), timeout)
+	if err == nil {
+		return nil
+	}
+	res, cerr := k.kubectl(fmt.Sprintf(`get deployment/%s -n %s -o jsonpath='{range .status.conditions[*]}{.type}={.status} {.reason}: {.message}{"\n"}{end}'`, deployment, namespace), true)
+	if cerr != nil || strings.TrimSpace(res.Stdout) == "" {
+		return fmt.Errorf("rollout of deployment %s/%s failed: %w", namespace, deployment, err)
+	}
+	return fmt.Errorf("rollout of deployment %s/%s failed: %w\nconditions:\n%s", namespace, deployment, err, strings.TrimSpace(res.Stdout))
+}
@@ -0,0 +1,360 @@
+package k3sflux
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// defaultDiffTargets are diffed when Config.DiffTargets is empty, with the
+// cluster directory at bootstrapPath.
+func defaultDiffTargets(bootstrapPath string) []DiffTarget {
+	return []DiffTarget{
+		{Name: "infra-custom", Path: "infra"},
+		{Name: "apps", Path: "apps"},
+		{Name: "flux-system", Path: bootstrapPath},
+	}
+}
+
+// diffTargets returns Config.DiffTargets, or the defaults when unset.
+func (k *K8sInstance) diffTargets() []DiffTarget {
+	if len(k.cfg.DiffTargets) == 0 {
+		return defaultDiffTargets(k.cfg.Bootstrap.Path)
+	}
+	return k.cfg.DiffTargets
+}
+
+// PhaseResult is the outcome of one step of the workflow.
+type PhaseResult struct {
+	Name     string
+	Started  time.Time
+	Finished time.Time
+	Output   string
+	// Error is empty when the phase succeeded.
+	Error string
+}
+
+// KustomizationReadiness is the Ready condition of a Kustomization.
+type KustomizationReadiness struct {
+	Name      string
+	Namespace string
+	Ready     bool
+	Reason    string
+	Message   string
+}
+
+// NodeReadiness is the Ready condition of a node.
+type NodeReadiness struct {
+	Name  string
+	Ready bool
+}
+
+// HelmReleaseReadiness is the Ready condition of a HelmRelease.
+type HelmReleaseReadiness struct {
+	Name         string
+	Namespace    string
+	ChartVersion string
+	Ready        bool
+	Reason       string
+	Message      string
+}
+
+// RunResult describes a whole run: the cluster, every phase with its
+// timings, the readiness of the kustomizations and the diff results.
+type RunResult struct {
+	// Cluster is Config.Name.
+	Cluster  string
+	Started  time.Time
+	Finished time.Time
+	// Nodes is the node listing of the cluster once it is up.
+	Nodes          string
+	NodeReadiness  []NodeReadiness
+	Phases         []PhaseResult
+	Kustomizations []KustomizationReadiness
+	HelmReleases   []HelmReleaseReadiness
+	Diffs          []*FluxDiff
+	Policies       []PolicyCheckResult
+	// Warnings are the non-fatal problems met on the way, such as a diff
+	// target that could not be diffed or a missing bootstrap path.
+	Warnings []string
+	// Error is the failure that aborted the run, empty when it completed.
+	// Failing diffs do not abort the run and are only reported in Phases.
+	Error string
+}
+
+// Failed reports whether the run was aborted.
+func (r *RunResult) Failed() bool {
+	return r.Error != ""
+}
+
+// Drifted lists the kustomizations whose diff found changes.
+func (r *RunResult) Drifted() []string {
+	var drifted []string
+	for _, d := range r.Diffs {
+		if d.DriftDetected() {
+			drifted = append(drifted, d.Kustomization)
+		}
+	}
+	return drifted
+}
+
+// SummaryLine condenses the result into one line for a CI status check,
+// e.g. "3 kustomizations, 2 drifted (5 resources), 0 errors". The format is
+// fixed, nouns are not singularized, so it can be parsed back: kustomizations
+// counts the diffed kustomizations, resources the changes and deletions of
+// the drifted ones and errors the failed phases.
+func SummaryLine(result RunResult) string {
+	var drifted, resources, failed int
+	for _, d := range result.Diffs {
+		if d.DriftDetected() {
+			drifted++
+			resources += len(d.Changes) + len(d.Deletions)
+		}
+	}
+	for _, p := range result.Phases {
+		if p.Error != "" {
+			failed++
+		}
+	}
+	return fmt.Sprintf("%d kustomizations, %d drifted (%d resources), %d errors", len(result.Diffs), drifted, resources, failed)
+}
+
+// ExitCode is the process exit status for the result: 1 when the run was
+// aborted, completed with warnings and cfg.FailOnWarnings is set, or found
+// drift and cfg.FailOnDiff is set, 0 otherwise.
+func (r *RunResult) ExitCode(cfg Config) int {
+	if r.Failed() || (cfg.FailOnWarnings && len(r.Warnings) > 0) || (cfg.FailOnDiff && len(r.Drifted()) > 0) {
+		return 1
+	}
+	return 0
+}
+
+// phase runs fn as the named phase, recording its output and error.
+func (r *RunResult) phase(name string, fn func() (string, error)) error {
+	p := PhaseResult{Name: name, Started: time.Now()}
+	out, err := fn()
+	p.Finished = time.Now()
+	p.Output = out
+	if err != nil {
+		p.Error = err.Error()
+	}
+	r.Phases = append(r.Phases, p)
+	return err
+}
+
+// stdout keeps the standard output of a command wrapper result.
+func stdout(res ExecResult, err error) (string, error) {
+	return res.Stdout, err
+}
+
+// waitForSystemPodsPhase waits for the system pods when
+// Config.SystemPodsTimeout is set.
+func (k *K8sInstance) waitForSystemPodsPhase() (string, error) {
+	if k.cfg.SystemPodsTimeout == 0 {
+		return "", nil
+	}
+	return "", k.WaitForSystemPods(k.cfg.SystemPodsTimeout)
+}
+
+// waitForFluxPodsPhase waits for the flux-system pods bootstrap installed
+// when Config.SystemPodsTimeout is set.
+func (k *K8sInstance) waitForFluxPodsPhase() (string, error) {
+	if k.cfg.SystemPodsTimeout == 0 {
+		return "", nil
+	}
+	return "", k.waitForPods([]string{"flux-system"}, k.cfg.SystemPodsTimeout)
+}
+
+// Run starts the cluster, bootstraps flux, waits for the apps to reconcile
+// and diffs the targets against it. Errors, and panics, are recorded in the
+// result rather than returned. A failed run writes the collectDiagnostics
+// bundle to Config.DiagnosticsDir, when set.
+func (k *K8sInstance) Run() *RunResult {
+	r := &RunResult{Cluster: k.cfg.Name, Started: time.Now()}
+	defer func() {
+		if p := recover(); p != nil {
+			r.Error = fmt.Sprintf("panic: %v", p)
+		}
+		if r.Failed() && k.cfg.DiagnosticsDir != "" {
+			if err := k.exportDiagnostics(k.cfg.DiagnosticsDir); err != nil {
+				k.warnf("failed to write diagnostics: %v", err)
+			}
+		}
+		r.Warnings = append(r.Warnings, k.warnings...)
+		r.Finished = time.Now()
+	}()
+
+	abort := func(err error) *RunResult {
+		r.Error = err.Error()
+		return r
+	}
+	steps := []struct {
+		name string
+		fn   func() (string, error)
+	}{
+		{"start", func() (string, error) { return "", k.start() }},
+		{"export kubeconfig", func() (string, error) {
+			if k.cfg.KubeconfigPath == "" {
+				return "", nil
+			}
+			return "", k.ExportKubeconfig(k.cfg.KubeconfigPath)
+		}},
+		{"system pods", k.waitForSystemPodsPhase},
+		{"pre-pull images", func() (string, error) {
+			if len(k.cfg.PrePullImages) == 0 {
+				return "", nil
+			}
+			statuses, err := k.PrePullImages(k.cfg.PrePullImages)
+			return ImagePullReport(statuses), err
+		}},
+		{"git head", func() (string, error) {
+			if !k.cfg.CleanupGitCommits {
+				return "", nil
+			}
+			return k.recordGitHead()
+		}},
+		{"bootstrap", func() (string, error) { return "", k.bootstrap() }},
+		{"flux pods", k.waitForFluxPodsPhase},
+		{"wait apps", func() (string, error) {
+			return stdout(k.kubectlWait(k.container, "kustomization/apps --for=condition=ready -n flux-system", 5*time.Minute))
+		}},
+		{"wait helmreleases", func() (string, error) { return "", k.waitForHelmReleases("", 5*time.Minute) }},
+		{"nodes", func() (string, error) {
+			res, err := k.kubectl("get nodes -o wide", false)
+			r.Nodes = res.Stdout
+			return res.Stdout, err
+		}},
+		{"helmreleases", func() (string, error) { return stdout(k.kubectl("get hr -A -o wide", false)) }},
+		{"pods", func() (string, error) { return stdout(k.kubectl("get pods -A -o wide", false)) }},
+		{"helm releases", func() (string, error) { return stdout(k.helm("ls -A", false)) }},
+	}
+	for _, step := range steps {
+		if err := r.phase(step.name, step.fn); err != nil {
+			return abort(fmt.Errorf("%s: %w", step.name, err))
+		}
+	}
+
+	items, err := k.kustomizations()
+	if err != nil {
+		return abort(err)
+	}
+	for _, ks := range items {
+		ready := ks.readyCondition()
+		r.Kustomizations = append(r.Kustomizations, KustomizationReadiness{
+			Name:      ks.Metadata.Name,
+			Namespace: ks.Metadata.Namespace,
+			Ready:     ready.Status == "True",
+			Reason:    ready.Reason,
+			Message:   ready.Message,
+		})
+	}
+	if err := k.collectReadiness(r); err != nil {
+		k.warnf("failed to read the node and helmrelease readiness: %v", err)
+	}
+
+	targets := k.diffTargets()
+	if k.cfg.DiffSelector != "" {
+		if targets, err = k.discoverDiffTargets(k.cfg.DiffSelector); err != nil {
+			return abort(err)
+		}
+	}
+	for _, target := range targets {
+		r.phase("diff "+target.Name, func() (string, error) {
+			d, err := k.Diff(target)
+			if err != nil {
+				k.warnf("skipped diff of %s: %v", target.Name, err)
+				return "", err
+			}
+			r.Diffs = append(r.Diffs, d)
+			return d.Output, nil
+		})
+	}
+	for _, check := range k.cfg.PolicyChecks {
+		r.phase("policies "+check.ManifestsPath, func() (string, error) {
+			result, err := k.EvaluatePolicies(check.ManifestsPath, check.PoliciesPath)
+			if err != nil {
+				k.warnf("skipped policies of %s: %v", check.ManifestsPath, err)
+				return "", err
+			}
+			r.Policies = append(r.Policies, PolicyCheckResult{PolicyCheck: check, PolicyResult: result})
+			return "", nil
+		})
+	}
+	if k.cfg.CleanupGitCommits {
+		if err := r.phase("cleanup git", k.CleanupGitCommits); err != nil {
+			k.warnf("left the commits of the run on %s: %v", k.cfg.Bootstrap.Branch, err)
+		}
+	}
+	return r
+}
+
+// Execute connects to Dagger and runs the whole workflow from cfg alone:
+// start, bootstrap, wait and diff. The error reports a failure to reach the
+// engine or to write Config.LogsDir; the outcome of the run itself,
+// including its failure, is in the result.
+func Execute(ctx context.Context, cfg Config) (*RunResult, error) {
+	client, err := connect(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	k := newConfiguredInstance(ctx, client, cfg)
+	if cfg.ResetConfigCache {
+		defer func() {
+			if err := k.Cleanup(); err != nil {
+				log.Print(err)
+			}
+		}()
+	}
+	result := k.Run()
+	if cfg.LogsDir != "" {
+		if err := k.ExportLogs(cfg.LogsDir); err != nil {
+			return result, fmt.Errorf("failed to export logs: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// connect opens the Dagger session, logging the engine progress to
+// Config.LogOutput.
+func connect(ctx context.Context, cfg Config) (*dagger.Client, error) {
+	logOutput := cfg.LogOutput
+	if logOutput == nil {
+		logOutput = os.Stderr
+	}
+	client, err := dagger.Connect(ctx, dagger.WithLogOutput(logOutput))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to dagger: %w", err)
+	}
+	return client, nil
+}
+
+// newConfiguredInstance is NewK8sInstance with the options Config carries
+// for the With* methods applied.
+func newConfiguredInstance(ctx context.Context, client *dagger.Client, cfg Config) *K8sInstance {
+	return NewK8sInstance(ctx, client, cfg).withConfigOptions()
+}
+
+// withConfigOptions calls the With* methods for the options Config carries.
+func (k *K8sInstance) withConfigOptions() *K8sInstance {
+	cfg := k.cfg
+	if cfg.GitTokenFile != "" {
+		k.WithGitTokenFile(cfg.GitTokenFile)
+	}
+	if cfg.BootstrapAuth == BootstrapAuthSSH {
+		k.WithSSHAuth(cfg.SSHPrivateKeyFile, cfg.SSHKnownHostsFile)
+	}
+	for _, host := range sortedKeys(cfg.RegistryMirrors) {
+		k.WithRegistryMirror(host, cfg.RegistryMirrors[host])
+	}
+	for _, host := range sortedKeys(cfg.RegistryTLS) {
+		tls := cfg.RegistryTLS[host]
+		k.WithRegistryTLS(host, tls.CAFile, tls.InsecureSkipVerify)
+	}
+	return k
+}
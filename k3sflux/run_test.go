@@ -0,0 +1,128 @@
+package k3sflux
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunResultExitCode(t *testing.T) {
+	drift := &FluxDiff{Kustomization: "apps", Changes: []DiffEntry{{Action: "drifted"}}}
+	tests := []struct {
+		name   string
+		result RunResult
+		cfg    Config
+		want   int
+	}{
+		{name: "clean", want: 0},
+		{name: "aborted", result: RunResult{Error: "bootstrap failed"}, want: 1},
+		{name: "warnings", result: RunResult{Warnings: []string{"path missing"}}, want: 0},
+		{name: "warnings with FailOnWarnings", result: RunResult{Warnings: []string{"path missing"}}, cfg: Config{FailOnWarnings: true}, want: 1},
+		{name: "drift", result: RunResult{Diffs: []*FluxDiff{drift}}, want: 0},
+		{name: "drift with FailOnDiff", result: RunResult{Diffs: []*FluxDiff{drift}}, cfg: Config{FailOnDiff: true}, want: 1},
+		{name: "no drift with FailOnDiff", result: RunResult{Diffs: []*FluxDiff{{Kustomization: "apps"}}}, cfg: Config{FailOnDiff: true}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.result.ExitCode(tt.cfg); got != tt.want {
+				t.Errorf("ExitCode() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummaryLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		result RunResult
+		want   string
+	}{
+		{name: "empty run", want: "0 kustomizations, 0 drifted (0 resources), 0 errors"},
+		{
+			name: "drift and failed phase",
+			result: RunResult{
+				Diffs: []*FluxDiff{
+					{Kustomization: "apps", Changes: []DiffEntry{{Action: "drifted"}, {Action: "created"}}, Deletions: []DiffEntry{{Action: "deleted"}}},
+					{Kustomization: "infra"},
+					{Kustomization: "monitoring", Deletions: []DiffEntry{{Action: "deleted"}}},
+				},
+				Phases: []PhaseResult{{Name: "start"}, {Name: "diff-infra", Error: "flux diff failed"}},
+			},
+			want: "3 kustomizations, 2 drifted (4 resources), 1 errors",
+		},
+		{
+			name:   "pending objects are not drift",
+			result: RunResult{Diffs: []*FluxDiff{{Kustomization: "apps", CRDPending: []DiffEntry{{Action: "created"}}}}},
+			want:   "1 kustomizations, 0 drifted (0 resources), 0 errors",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SummaryLine(tt.result); got != tt.want {
+				t.Errorf("SummaryLine() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithConfigOptions(t *testing.T) {
+	dir := t.TempDir()
+	token := filepath.Join(dir, "token")
+	if err := os.WriteFile(token, []byte("ghp_file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ca := filepath.Join(dir, "ca.pem")
+	cert := testCertificate(t)
+	if err := os.WriteFile(ca, cert, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		GitToken:        "ghp_flag",
+		GitTokenFile:    token,
+		RegistryMirrors: map[string]string{"docker.io": "https://mirror.example.com", "ghcr.io": "http://ghcr-mirror:5000"},
+		RegistryTLS: map[string]RegistryTLS{
+			"mirror.example.com": {CAFile: ca},
+			"ghcr-mirror:5000":   {InsecureSkipVerify: true},
+		},
+	}
+	k := offline(cfg, RecordedExecutor{}).withConfigOptions()
+	if k.err != nil {
+		t.Fatal(k.err)
+	}
+	if got := k.token(); got != "ghp_file" {
+		t.Errorf("token() = %q, want the GitTokenFile token", got)
+	}
+	mirrors := map[string][]string{"docker.io": {"https://mirror.example.com"}, "ghcr.io": {"http://ghcr-mirror:5000"}}
+	if !reflect.DeepEqual(k.registries.mirrors, mirrors) {
+		t.Errorf("mirrors = %v, want %v", k.registries.mirrors, mirrors)
+	}
+	configs := map[string]registryTLS{
+		"mirror.example.com": {caCert: string(cert)},
+		"ghcr-mirror:5000":   {insecureSkipVerify: true},
+	}
+	if !reflect.DeepEqual(k.registries.configs, configs) {
+		t.Errorf("configs = %+v, want %+v", k.registries.configs, configs)
+	}
+}
+
+func TestWithConfigOptionsError(t *testing.T) {
+	cfg := Config{GitTokenFile: filepath.Join(t.TempDir(), "missing")}
+	k := offline(cfg, RecordedExecutor{}).withConfigOptions()
+	if k.err == nil || !strings.Contains(k.err.Error(), "failed to read git token file") {
+		t.Errorf("err = %v, want the token file error", k.err)
+	}
+}
+
+func TestWaitForFluxPodsPhase(t *testing.T) {
+	// only the flux-system pods are recorded, listing kube-system fails
+	k := offline(Config{SystemPodsTimeout: time.Nanosecond}, RecordedExecutor{
+		"kubectl get pods -n flux-system -o json": {Stdout: `{"items": [{"metadata": {"name": "source-controller-7d9f", "namespace": "flux-system"}, "status": {"phase": "Pending"}}]}`},
+	})
+	_, err := k.waitForFluxPodsPhase()
+	if err == nil || !strings.Contains(err.Error(), "flux-system/source-controller-7d9f (Pending)") {
+		t.Errorf("waitForFluxPodsPhase() error = %v, want the pending flux pod", err)
+	}
+}
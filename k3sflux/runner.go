@@ -0,0 +1,89 @@
+// Package k3sflux runs flux on an ephemeral k3s cluster inside Dagger to
+// diff the changes of a flux repository against what the cluster would
+// apply. Execute runs the whole workflow in one call; Runner drives it step
+// by step for callers embedding the harness, e.g. integration tests.
+package k3sflux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"dagger.io/dagger"
+)
+
+// Runner drives the workflow one step at a time: Start, Bootstrap, Diff,
+// then Close. The K8sInstance it drives is available through Instance for
+// the helpers it does not wrap.
+type Runner struct {
+	client *dagger.Client
+	k      *K8sInstance
+}
+
+// NewRunner connects to Dagger and prepares a cluster from cfg, applying
+// the options Config carries for the With* methods like Execute does.
+// Close must be called once the Runner is no longer needed.
+func NewRunner(ctx context.Context, cfg Config) (*Runner, error) {
+	client, err := connect(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Runner{client: client, k: newConfiguredInstance(ctx, client, cfg)}, nil
+}
+
+// Instance returns the K8sInstance of the runner.
+func (r *Runner) Instance() *K8sInstance {
+	return r.k
+}
+
+// Start starts the k3s cluster and waits for its nodes.
+func (r *Runner) Start(ctx context.Context) error {
+	r.k.ctx = ctx
+	return r.k.start()
+}
+
+// Bootstrap bootstraps flux from b, or from Config.Bootstrap when b is the
+// zero value. The repository diffed by Diff stays the one Start cloned.
+func (r *Runner) Bootstrap(ctx context.Context, b BootstrapConfig) error {
+	if r.k.container == nil {
+		return errors.New("the cluster has not been started")
+	}
+	r.k.ctx = ctx
+	if b != (BootstrapConfig{}) {
+		r.k.cfg.Bootstrap = b.withDefaults()
+	}
+	return r.k.bootstrap()
+}
+
+// Diff diffs the targets in order. The diffs that succeeded are returned
+// next to an error joining the targets that could not be diffed.
+func (r *Runner) Diff(ctx context.Context, targets []DiffTarget) ([]*FluxDiff, error) {
+	if r.k.container == nil {
+		return nil, errors.New("the cluster has not been started")
+	}
+	r.k.ctx = ctx
+	var diffs []*FluxDiff
+	var errs []error
+	for _, target := range targets {
+		d, err := r.k.Diff(target)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		diffs = append(diffs, d)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return diffs, fmt.Errorf("failed to diff %d of %d target(s): %w", len(errs), len(targets), err)
+	}
+	return diffs, nil
+}
+
+// Close ends the Dagger session, which stops the cluster. The config cache
+// is emptied first when Config.ResetConfigCache is set.
+func (r *Runner) Close() error {
+	var err error
+	if r.k.cfg.ResetConfigCache {
+		err = r.k.Cleanup()
+	}
+	return errors.Join(err, r.client.Close())
+}
@@ -0,0 +1,137 @@
+package k3sflux
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const (
+	sarifVersion = "2.1.0"
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+)
+
+// sarifRules are the rules FormatSARIF reports results for.
+var sarifRules = []sarifRule{
+	{ID: "flux-drift", ShortDescription: sarifText{"Applying the kustomization creates or changes an object"}, DefaultConfiguration: sarifConfiguration{"warning"}},
+	{ID: "flux-prune", ShortDescription: sarifText{"Applying the kustomization prunes an object"}, DefaultConfiguration: sarifConfiguration{"error"}},
+	{ID: "policy-violation", ShortDescription: sarifText{"A conftest deny rule matched the rendered manifests"}, DefaultConfiguration: sarifConfiguration{"error"}},
+	{ID: "policy-warning", ShortDescription: sarifText{"A conftest warn rule matched the rendered manifests"}, DefaultConfiguration: sarifConfiguration{"warning"}},
+}
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID                   string             `json:"id"`
+	ShortDescription     sarifText          `json:"shortDescription"`
+	DefaultConfiguration sarifConfiguration `json:"defaultConfiguration"`
+}
+
+type sarifConfiguration struct {
+	Level string `json:"level"`
+}
+
+type sarifText struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifText       `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation  `json:"physicalLocation"`
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifLogicalLocation struct {
+	FullyQualifiedName string `json:"fullyQualifiedName"`
+	Kind               string `json:"kind"`
+}
+
+// FormatSARIF renders the drift and the policy matches of result as a SARIF
+// 2.1.0 log for security dashboards. Every changed object is a flux-drift
+// result and every pruned one a flux-prune result, located at the path of
+// its kustomization in the repository and named by its object reference;
+// policy matches are located at the checked manifests path.
+func FormatSARIF(result RunResult) ([]byte, error) {
+	results := []sarifResult{}
+	for _, d := range result.Diffs {
+		uri := repoPath(d.Path)
+		for _, e := range d.Changes {
+			results = append(results, objectResult("flux-drift", "warning", uri, d.Kustomization, e))
+		}
+		for _, e := range d.Deletions {
+			results = append(results, objectResult("flux-prune", "error", uri, d.Kustomization, e))
+		}
+	}
+	for _, p := range result.Policies {
+		location := sarifLocation{PhysicalLocation: sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: p.ManifestsPath}}}
+		for _, v := range p.Violations {
+			results = append(results, sarifResult{RuleID: "policy-violation", Level: "error", Message: sarifText{v.Namespace + ": " + v.Message}, Locations: []sarifLocation{location}})
+		}
+		for _, w := range p.Warnings {
+			results = append(results, sarifResult{RuleID: "policy-warning", Level: "warning", Message: sarifText{w.Namespace + ": " + w.Message}, Locations: []sarifLocation{location}})
+		}
+	}
+	return json.MarshalIndent(sarifLog{
+		Version: sarifVersion,
+		Schema:  sarifSchema,
+		Runs: []sarifRun{{
+			Tool: sarifTool{Driver: sarifDriver{
+				Name:           "dagger-flux-k3s",
+				InformationURI: "https://github.com/Shaked/dagger-flux-k3s",
+				Rules:          sarifRules,
+			}},
+			Results: results,
+		}},
+	}, "", "  ")
+}
+
+// objectResult is the SARIF result of a diffed object.
+func objectResult(ruleID, level, uri, kustomization string, e DiffEntry) sarifResult {
+	return sarifResult{
+		RuleID:  ruleID,
+		Level:   level,
+		Message: sarifText{"kustomization " + kustomization + ": " + e.ResourceRef.String() + " " + e.Action},
+		Locations: []sarifLocation{{
+			PhysicalLocation: sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: uri}},
+			LogicalLocations: []sarifLogicalLocation{{FullyQualifiedName: e.ResourceRef.String(), Kind: "resource"}},
+		}},
+	}
+}
+
+// repoPath makes a diffed path relative to the cloned repository, as SARIF
+// locations are relative to the repository root.
+func repoPath(p string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(p, srcDir), "/")
+}
@@ -0,0 +1,92 @@
+package k3sflux
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// assertGolden compares got with testdata/name, rewriting the file instead
+// with -update.
+func assertGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	p := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(p, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("%s differs, rerun with -update to accept:\n%s", p, got)
+	}
+}
+
+// goldenRunResult is a run with drift, a prune, a failed phase and policy
+// matches, rendered by the golden tests of the output formats.
+func goldenRunResult() RunResult {
+	started := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	return RunResult{
+		Cluster:  "ci",
+		Started:  started,
+		Finished: started.Add(95 * time.Second),
+		Phases: []PhaseResult{
+			{Name: "start", Started: started, Finished: started.Add(40 * time.Second)},
+			{Name: "diff-apps", Started: started.Add(40 * time.Second), Finished: started.Add(52500 * time.Millisecond)},
+			{Name: "diff-infra", Started: started.Add(52500 * time.Millisecond), Finished: started.Add(60 * time.Second), Error: "flux diff failed"},
+		},
+		Kustomizations: []KustomizationReadiness{
+			{Name: "flux-system", Namespace: "flux-system", Ready: true},
+			{Name: "apps", Namespace: "flux-system", Reason: "ReconciliationFailed"},
+		},
+		Diffs: []*FluxDiff{
+			{
+				Kustomization: "apps",
+				Path:          "/src/apps/production",
+				Changes: []DiffEntry{
+					{ResourceRef: ResourceRef{Kind: "Deployment", Namespace: "default", Name: "web"}, Action: "drifted"},
+					{ResourceRef: ResourceRef{Kind: "Namespace", Name: "web"}, Action: "created"},
+				},
+				Deletions: []DiffEntry{
+					{ResourceRef: ResourceRef{Kind: "ConfigMap", Namespace: "default", Name: "old"}, Action: "deleted"},
+				},
+			},
+			{Kustomization: "infra", Path: "/src/infrastructure"},
+		},
+		Policies: []PolicyCheckResult{{
+			PolicyCheck: PolicyCheck{ManifestsPath: "apps/production", PoliciesPath: "policy"},
+			PolicyResult: PolicyResult{
+				Violations: []PolicyViolation{{Namespace: "main", Message: "Deployment web runs as root"}},
+				Warnings:   []PolicyViolation{{Namespace: "main", Message: "Deployment web has no resource limits"}},
+			},
+		}},
+		Warnings: []string{`diff target "infra" could not be diffed`},
+	}
+}
+
+func TestFormatSARIF(t *testing.T) {
+	tests := []struct {
+		name   string
+		result RunResult
+		golden string
+	}{
+		{name: "empty run", golden: "sarif-empty.golden"},
+		{name: "drift and policies", result: goldenRunResult(), golden: "sarif.golden"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FormatSARIF(tt.result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertGolden(t, tt.golden, got)
+		})
+	}
+}
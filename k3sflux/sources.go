@@ -0,0 +1,85 @@
+package k3sflux
+
+import (
+	"fmt"
+)
+
+// SourceRef pins the revision of a flux source. Exactly one field must be
+// set.
+type SourceRef struct {
+	Branch string
+	Tag    string
+	// SemVer is a semver range, e.g. ">=1.0.0 <2.0.0".
+	SemVer string
+	Commit string
+}
+
+// gitFlag maps the ref to its flux create source git flag.
+func (r SourceRef) gitFlag() (string, error) {
+	var flags []string
+	for _, f := range []struct{ flag, value string }{
+		{"--branch", r.Branch},
+		{"--tag", r.Tag},
+		{"--tag-semver", r.SemVer},
+		{"--commit", r.Commit},
+	} {
+		if f.value != "" {
+			flags = append(flags, f.flag+"="+shellQuote(f.value))
+		}
+	}
+	if len(flags) != 1 {
+		return "", fmt.Errorf("source ref needs exactly one of branch, tag, semver or commit, got %d", len(flags))
+	}
+	return flags[0], nil
+}
+
+// chartVersionFlag maps the ref to the --chart-version of a HelmRelease,
+// which takes either an exact version or a semver range.
+func (r SourceRef) chartVersionFlag() (string, error) {
+	if r.Branch != "" || r.Commit != "" || (r.Tag != "" && r.SemVer != "") {
+		return "", fmt.Errorf("helm charts are pinned by either a tag or a semver range")
+	}
+	version := r.Tag
+	if version == "" {
+		version = r.SemVer
+	}
+	if version == "" {
+		return "", nil
+	}
+	return "--chart-version=" + shellQuote(version), nil
+}
+
+// CreateGitSource creates a GitRepository source pinned to ref.
+func (k *K8sInstance) CreateGitSource(name, namespace, url string, ref SourceRef) error {
+	flag, err := ref.gitFlag()
+	if err != nil {
+		return err
+	}
+	if _, err := k.flux(fmt.Sprintf("create source git %s -n %s --url=%s %s", name, namespace, shellQuote(url), flag), true); err != nil {
+		return fmt.Errorf("failed to create git source %s/%s: %w", namespace, name, err)
+	}
+	return nil
+}
+
+// CreateHelmRepository creates a HelmRepository source.
+func (k *K8sInstance) CreateHelmRepository(name, namespace, url string) error {
+	if _, err := k.flux(fmt.Sprintf("create source helm %s -n %s --url=%s", name, namespace, shellQuote(url)), true); err != nil {
+		return fmt.Errorf("failed to create helm repository %s/%s: %w", namespace, name, err)
+	}
+	return nil
+}
+
+// CreateHelmRelease creates a HelmRelease of chart from the HelmRepository
+// called source, pinned by ref's Tag (an exact version) or SemVer range. An
+// empty ref follows the latest chart version.
+func (k *K8sInstance) CreateHelmRelease(name, namespace, source, chart string, ref SourceRef) error {
+	flag, err := ref.chartVersionFlag()
+	if err != nil {
+		return err
+	}
+	command := fmt.Sprintf("create helmrelease %s -n %s --source=HelmRepository/%s --chart=%s %s", name, namespace, source, shellQuote(chart), flag)
+	if _, err := k.flux(command, true); err != nil {
+		return fmt.Errorf("failed to create helmrelease %s/%s: %w", namespace, name, err)
+	}
+	return nil
+}
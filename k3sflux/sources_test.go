@@ -0,0 +1,68 @@
+package k3sflux
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSourceRefGitFlag(t *testing.T) {
+	tests := []struct {
+		name    string
+		ref     SourceRef
+		want    string
+		wantErr bool
+	}{
+		{name: "branch", ref: SourceRef{Branch: "main"}, want: "--branch='main'"},
+		{name: "tag", ref: SourceRef{Tag: "v1.2.0"}, want: "--tag='v1.2.0'"},
+		{name: "semver", ref: SourceRef{SemVer: ">=1.0.0 <2.0.0"}, want: "--tag-semver='>=1.0.0 <2.0.0'"},
+		{name: "commit", ref: SourceRef{Commit: "2f1c3d4"}, want: "--commit='2f1c3d4'"},
+		{name: "none", wantErr: true},
+		{name: "several", ref: SourceRef{Branch: "main", Tag: "v1.2.0"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.ref.gitFlag()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("gitFlag() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("gitFlag() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSourceRefChartVersionFlag(t *testing.T) {
+	tests := []struct {
+		name    string
+		ref     SourceRef
+		want    string
+		wantErr bool
+	}{
+		{name: "latest"},
+		{name: "version", ref: SourceRef{Tag: "6.4.0"}, want: "--chart-version='6.4.0'"},
+		{name: "range", ref: SourceRef{SemVer: "6.x"}, want: "--chart-version='6.x'"},
+		{name: "branch", ref: SourceRef{Branch: "main"}, wantErr: true},
+		{name: "version and range", ref: SourceRef{Tag: "6.4.0", SemVer: "6.x"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.ref.chartVersionFlag()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("chartVersionFlag() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("chartVersionFlag() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateGitSource(t *testing.T) {
+	k := NewOfflineInstance(context.Background(), Config{}, RecordedExecutor{
+		"flux create source git podinfo -n flux-system --url='https://github.com/stefanprodan/podinfo' --tag-semver='6.x'": {},
+	})
+	if err := k.CreateGitSource("podinfo", "flux-system", "https://github.com/stefanprodan/podinfo", SourceRef{SemVer: "6.x"}); err != nil {
+		t.Fatal(err)
+	}
+}
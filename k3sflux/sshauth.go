@@ -0,0 +1,105 @@
+package k3sflux
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const (
+	// sshKeyPath is where the WithSSHAuth key is mounted in the tools
+	// container.
+	sshKeyPath = "/ssh/identity"
+	// sshKnownHostsPath is the system wide known_hosts file ssh reads.
+	sshKnownHostsPath = "/etc/ssh/ssh_known_hosts"
+)
+
+// WithSSHAuth switches the clone and flux bootstrap to SSH with the private
+// key in privateKeyFile, e.g. a deploy key with write access. knownHostsFile
+// holds the host keys of the git host; when empty they are scanned on start,
+// trusting whatever the host presents. It must be called before start; a
+// missing or empty file is reported by start.
+func (k *K8sInstance) WithSSHAuth(privateKeyFile, knownHostsFile string) *K8sInstance {
+	if err := k.requireSession("WithSSHAuth"); err != nil {
+		k.setErr(err)
+		return k
+	}
+	key, err := os.ReadFile(privateKeyFile)
+	if err != nil {
+		k.setErr(fmt.Errorf("failed to read SSH private key: %w", err))
+		return k
+	}
+	if strings.TrimSpace(string(key)) == "" {
+		k.setErr(fmt.Errorf("SSH private key file %s is empty", privateKeyFile))
+		return k
+	}
+	if knownHostsFile != "" {
+		hosts, err := os.ReadFile(knownHostsFile)
+		if err != nil {
+			k.setErr(fmt.Errorf("failed to read SSH known hosts: %w", err))
+			return k
+		}
+		k.knownHosts = string(hosts)
+	}
+	k.sshKey = k.client.SetSecret("ssh-key", string(key))
+	k.cfg.BootstrapAuth = BootstrapAuthSSH
+	return k
+}
+
+// withGitAuth sets up ssh for git in the tools container when
+// Config.BootstrapAuth is BootstrapAuthSSH; token auth needs nothing more
+// than the GITHUB_TOKEN variable.
+func (k *K8sInstance) withGitAuth(c *dagger.Container) *dagger.Container {
+	if k.cfg.BootstrapAuth != BootstrapAuthSSH {
+		return c
+	}
+	c = c.WithMountedSecret(sshKeyPath, k.sshKey).
+		WithEnvVariable("GIT_SSH_COMMAND", "ssh -i "+sshKeyPath+" -o IdentitiesOnly=yes")
+	if k.knownHosts != "" {
+		return c.WithNewFile(sshKnownHostsPath, dagger.ContainerWithNewFileOpts{Contents: k.knownHosts})
+	}
+	return c.WithExec([]string{"sh", "-c", fmt.Sprintf("ssh-keyscan %s > %s", k.cfg.Bootstrap.Hostname, sshKnownHostsPath)}, dagger.ContainerWithExecOpts{SkipEntrypoint: true})
+}
+
+// repoShellURL is the repository URL for git commands run in the tools
+// container, with the auth of Config.BootstrapAuth.
+func (k *K8sInstance) repoShellURL() string {
+	if k.cfg.BootstrapAuth == BootstrapAuthSSH {
+		return shellQuote(k.cfg.Bootstrap.sshURL())
+	}
+	return k.cfg.Bootstrap.shellURL()
+}
+
+// sshDiffSource clones the diff branch over ssh in the tools container,
+// since the Dagger git API only takes keys through an SSH agent socket. The
+// fetch names the commit ls-remote resolved, so a cached clone is only
+// reused while the branch has not moved. The clone goes through the
+// Executor like any command; the directory is then read from the same exec,
+// which the engine does not run again.
+func (k *K8sInstance) sshDiffSource() (*dagger.Directory, error) {
+	c := k.toolsContainer().With(k.withGitAuth).WithEntrypoint([]string{"sh", "-c"})
+	res, err := k.execIn(c, "git", "git ls-remote --heads "+k.repoShellURL(), true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repository branches: %w", err)
+	}
+	heads := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(res.Stdout), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			heads[strings.TrimPrefix(fields[1], "refs/heads/")] = fields[0]
+		}
+	}
+	ref, err := k.pickBranch(sortedKeys(heads), k.cfg.Bootstrap.GitRef)
+	if err != nil {
+		return nil, err
+	}
+	clone := fmt.Sprintf(
+		"git init -q %[1]s && git -C %[1]s fetch -q --depth 1 %[2]s %[3]s && git -C %[1]s checkout -q FETCH_HEAD",
+		srcDir, k.repoShellURL(), heads[ref],
+	)
+	if _, err := k.execIn(c, "git", clone, false); err != nil {
+		return nil, fmt.Errorf("failed to clone %s: %w", ref, err)
+	}
+	return c.WithExec([]string{clone}).Directory(srcDir), nil
+}
@@ -0,0 +1,48 @@
+package k3sflux
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// forceDeleteTimeout bounds the wait for a force deleted namespace to go.
+const forceDeleteTimeout = time.Minute
+
+// ForceDeleteNamespace deletes a namespace stuck in Terminating by stripping
+// the finalizers of the objects left in it and of the namespace itself.
+// Finalizers exist to let controllers clean up external state, so this is a
+// deliberate escape hatch for the ephemeral cluster, never used by the
+// regular teardown.
+func (k *K8sInstance) ForceDeleteNamespace(name string) error {
+	if _, err := k.kubectl(fmt.Sprintf("delete namespace %s --wait=false --ignore-not-found", name), true); err != nil {
+		return fmt.Errorf("failed to delete namespace %s: %w", name, err)
+	}
+	res, err := k.kubectl(fmt.Sprintf("get namespace %s --ignore-not-found -o name", name), true)
+	if err != nil {
+		return fmt.Errorf("failed to get namespace %s: %w", name, err)
+	}
+	if strings.TrimSpace(res.Stdout) == "" {
+		return nil
+	}
+	objects, err := k.liveObjects([]string{name})
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if len(o.Metadata.Finalizers) == 0 {
+			continue
+		}
+		if _, err := k.kubectl(fmt.Sprintf(`patch %s/%s -n %s --type=merge -p '{"metadata":{"finalizers":null}}'`, o.Kind, o.Metadata.Name, name), true); err != nil {
+			return fmt.Errorf("failed to remove finalizers of %s/%s in %s: %w", o.Kind, o.Metadata.Name, name, err)
+		}
+	}
+	finalize := fmt.Sprintf(`get namespace %[1]s -o json | jq '.spec.finalizers = []' | kubectl replace --raw /api/v1/namespaces/%[1]s/finalize -f -`, name)
+	if _, err := k.kubectl(finalize, true); err != nil {
+		return fmt.Errorf("failed to remove finalizers of namespace %s: %w", name, err)
+	}
+	if _, err := k.kubectlWait(k.container, "--for=delete namespace/"+name, forceDeleteTimeout); err != nil {
+		return fmt.Errorf("namespace %s still exists after removing its finalizers: %w", name, err)
+	}
+	return nil
+}
@@ -2,225 +2,313 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"dagger.io/dagger"
-)
 
-var (
-	fluxBootstrapCmd = `\
-		bootstrap github \
-		--owner=shaked \
-		--repository=fluxcd-test \
-		--branch=main \
-		--path=clusters/tests
-	`
-	githubToken = os.Getenv("GITHUB_TOKEN")
+	"github.com/Shaked/dagger-flux-k3s/k3sflux"
 )
 
-func NewK8sInstance(ctx context.Context, client *dagger.Client) *K8sInstance {
-	return &K8sInstance{
-		ctx:         ctx,
-		client:      client,
-		container:   nil,
-		configCache: client.CacheVolume("k3s_config"),
-	}
-}
-
-type K8sInstance struct {
-	ctx         context.Context
-	client      *dagger.Client
-	container   *dagger.Container
-	configCache *dagger.CacheVolume
-}
-
-func (k *K8sInstance) start() error {
-	// create k3s service container
-	k3s := k.client.Pipeline("k3s init").Container().
-		From("rancher/k3s").
-		WithMountedCache("/etc/rancher/k3s", k.configCache).
-		WithMountedTemp("/etc/lib/cni").
-		WithMountedTemp("/var/lib/kubelet").
-		WithMountedTemp("/var/lib/rancher/k3s").
-		WithMountedTemp("/var/log").
-		WithEntrypoint([]string{"sh", "-c"}).
-		WithExec([]string{"k3s server --bind-address $(ip route | grep src | awk '{print $NF}') --disable traefik --disable metrics-server"}, dagger.ContainerWithExecOpts{InsecureRootCapabilities: true}).
-		WithExposedPort(6443)
-
-	kubectlImage := k.client.Container().From("bitnami/kubectl")
-	helmImage := k.client.Container().From("alpine/helm")
-	fluxcdImage := k.client.Container().From("ghcr.io/fluxcd/flux-cli:v2.0.0-rc.5")
-
-	// the git repository containing code for the binary to be built
-	gitUrl := fmt.Sprintf("https://oauth2:%s@github.com/Shaked/fluxcd-test.git", githubToken)
-	gitRepo := k.client.Git(gitUrl).
-		Branch("diff").
-		Tree()
-
-	k.container = k.client.Container().
-		From("cgr.dev/chainguard/wolfi-base:latest").
-		// From("alpine:latest").
-		WithFile("/usr/local/bin/kubectl", kubectlImage.File("/opt/bitnami/kubectl/bin/kubectl")).
-		WithFile("/usr/local/bin/helm", helmImage.File("/usr/bin/helm")).
-		WithFile("/usr/local/bin/flux", fluxcdImage.File("/usr/local/bin/flux")).
-		WithExec([]string{"apk", "add", "--no-cache", "curl", "jq", "openssh-client", "git"}).
-		WithMountedCache("/cache/k3s", k.configCache).
-		WithServiceBinding("k3s", k3s).
-		WithEnvVariable("CACHE", time.Now().String()).
-		WithEnvVariable("KUBECONFIG", "/.kube/config").
-		WithEnvVariable("GITHUB_TOKEN", githubToken).
-		WithUser("root").
-		WithExec([]string{"mkdir", "-p", "/.kube"}).
-		WithExec([]string{"cp", "/cache/k3s/k3s.yaml", "/.kube/config"}, dagger.ContainerWithExecOpts{SkipEntrypoint: true}).
-		WithExec([]string{"chown", "1001:0", "/.kube/config"}, dagger.ContainerWithExecOpts{SkipEntrypoint: true}).
-		WithUser("root").
-		WithDirectory("/src", gitRepo).
-		WithWorkdir("/tmp").
-		// WithDirectory("/host", k.client.Directory()).
-		WithEntrypoint([]string{"sh", "-c"})
-
-	if err := k.waitForNodes(); err != nil {
-		return fmt.Errorf("failed to start k8s: %v", err)
-	}
-	return nil
-}
-
-func (k *K8sInstance) kubectl(command string) (string, error) {
-	return k.exec("kubectl", fmt.Sprintf("kubectl %v", command))
-}
-
-func (k *K8sInstance) helm(command string) (string, error) {
-	return k.exec("helm", fmt.Sprintf("helm %v", command))
-}
-
-func (k *K8sInstance) flux(command string) (string, error) {
-	return k.exec("flux", fmt.Sprintf("flux %v", command))
-}
-
-func (k *K8sInstance) git(command string) (string, error) {
-	return k.exec("git", fmt.Sprintf("git %v", command))
-}
+func main() {
+	prune := flag.Bool("prune", false, "empty the cache volumes created by this tool and exit")
+	logsDir := flag.String("logs-dir", "", "write the output of each pipeline to its own file in this directory")
+	diagnosticsDir := flag.String("diagnostics-dir", "", "write the state of the cluster to this directory when the run fails")
+	exportKubeconfig := flag.String("export-kubeconfig", "", "write the kubeconfig of the cluster to this path once it is ready")
+	failOnDiff := flag.Bool("fail-on-diff", false, "exit 1 when a kustomization drifted, same as FAIL_ON_DIFF=true")
+	reset := flag.Bool("reset", false, "empty the k3s config cache before starting the cluster and after the run")
+	output := flag.String("output", "text", "print the result as text, as a single JSON object with json or as a SARIF log with sarif or as Prometheus metrics with prometheus")
+	flag.Parse()
 
-func (k *K8sInstance) exec(name, command string) (string, error) {
-	return k.container.Pipeline(name).Pipeline(command).
-		WithEnvVariable("CACHE", time.Now().String()).
-		WithExec([]string{command}).
-		Stdout(k.ctx)
-}
+	ctx := context.Background()
 
-func (k *K8sInstance) waitForNodes() (err error) {
-	maxRetries := 5
-	retryBackoff := 5 * time.Second
-	for i := 0; i < maxRetries; i++ {
-		time.Sleep(retryBackoff)
-		kubectlGetNodes, err := k.kubectl("get nodes -o wide")
+	if *prune {
+		client, err := dagger.Connect(ctx, dagger.WithLogOutput(os.Stderr))
 		if err != nil {
-			fmt.Println(fmt.Errorf("could not fetch nodes: %v", err))
-			continue
+			panic(err)
 		}
-		if strings.Contains(kubectlGetNodes, "Ready") {
-			return nil
+		defer client.Close()
+		if err := k3sflux.PruneCaches(ctx, client); err != nil {
+			panic(err)
 		}
-		fmt.Println("waiting for k8s to start:", kubectlGetNodes)
+		return
 	}
-	return fmt.Errorf("k8s took too long to start")
-}
-
-func main() {
-	ctx := context.Background()
 
-	// create Dagger client
-	client, err := dagger.Connect(ctx, dagger.WithLogOutput(os.Stderr))
+	format, ok := outputFormats[*output]
+	if !ok {
+		log.Fatalf("invalid --output %q, expected text, json, sarif or prometheus", *output)
+	}
+	cfg, err := configFromEnv()
 	if err != nil {
 		panic(err)
 	}
-	defer client.Close()
-
-	k8s := NewK8sInstance(ctx, client)
-	if err = k8s.start(); err != nil {
+	cfg.LogsDir = *logsDir
+	cfg.DiagnosticsDir = *diagnosticsDir
+	cfg.KubeconfigPath = *exportKubeconfig
+	cfg.FailOnDiff = cfg.FailOnDiff || *failOnDiff
+	cfg.ResetConfigCache = *reset
+	k3sflux.AlwaysBustCache = os.Getenv("ALWAYS_BUST_CACHE") == "true"
+
+	result, err := k3sflux.Execute(ctx, cfg)
+	if result == nil {
 		panic(err)
 	}
-
-	_, err = k8s.flux(fluxBootstrapCmd)
-
 	if err != nil {
-		panic(err)
+		log.Print(err)
 	}
-
-	fluxWaitApps, err := k8s.kubectl(`wait kustomization/apps --for=condition=ready --timeout=5m -n flux-system`)
-	if err != nil {
-		panic(err)
+	switch format {
+	case k3sflux.OutputJSON:
+		if err := json.NewEncoder(os.Stdout).Encode(k3sflux.NewRunReport(result, cfg)); err != nil {
+			panic(err)
+		}
+		log.Print(k3sflux.SummaryLine(*result))
+	case k3sflux.OutputSARIF:
+		sarif, err := k3sflux.FormatSARIF(*result)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(sarif))
+		log.Print(k3sflux.SummaryLine(*result))
+	case k3sflux.OutputPrometheus:
+		fmt.Print(k3sflux.FormatPrometheus(*result))
+		log.Print(k3sflux.SummaryLine(*result))
+	default:
+		printResult(result)
 	}
-	fmt.Println(fluxWaitApps)
+	os.Exit(result.ExitCode(cfg))
+}
 
-	hr, err := k8s.kubectl("get hr -A -o wide")
-	if err != nil {
-		panic(err)
-	}
-	fmt.Println(hr)
+// outputFormats maps the --output values to their format.
+var outputFormats = map[string]k3sflux.OutputFormat{
+	"text":       k3sflux.OutputText,
+	"json":       k3sflux.OutputJSON,
+	"sarif":      k3sflux.OutputSARIF,
+	"prometheus": k3sflux.OutputPrometheus,
+}
 
-	pods, err := k8s.kubectl("get pods -A -o wide")
-	if err != nil {
-		panic(err)
+// configFromEnv builds the run configuration from the environment variables
+// documented in the README.
+func configFromEnv() (k3sflux.Config, error) {
+	var err error
+	cfg := k3sflux.DefaultConfig()
+	cfg.Name = os.Getenv("CLUSTER_NAME")
+	cfg.Rootless = os.Getenv("ROOTLESS") == "true"
+	cfg.ToolImages = k3sflux.ToolImages{
+		Kubectl: os.Getenv("KUBECTL_IMAGE"),
+		Helm:    os.Getenv("HELM_IMAGE"),
+		Flux:    os.Getenv("FLUX_IMAGE"),
 	}
-	fmt.Println(pods)
-
-	helm, err := k8s.helm("ls -A")
-	if err != nil {
-		panic(err)
+	cfg.WorkDir = os.Getenv("WORK_DIR")
+	cfg.GitToken = os.Getenv("GITHUB_TOKEN")
+	cfg.GitTokenFile = os.Getenv("GITHUB_TOKEN_FILE")
+	cfg.StrictPaths = os.Getenv("STRICT_PATHS") == "true"
+	hostname := os.Getenv("GITHUB_HOSTNAME")
+	if hostname == "" {
+		hostname = os.Getenv("GIT_HOST")
 	}
-	fmt.Println(helm)
-
-	ls, err := k8s.exec("ls", fmt.Sprintf("ls -la %v", "/src"))
-	if err != nil {
-		panic(err)
+	cfg.Bootstrap = k3sflux.BootstrapConfig{
+		Hostname:   hostname,
+		Owner:      os.Getenv("FLUX_OWNER"),
+		Repository: os.Getenv("FLUX_REPO"),
+		Branch:     os.Getenv("FLUX_BRANCH"),
+		Path:       os.Getenv("FLUX_PATH"),
+		Cluster:    os.Getenv("FLUX_CLUSTER"),
+		GitRef:     os.Getenv("DIFF_REF"),
 	}
-
-	fmt.Println("ls", ls)
-
-	hostDir := "/src"
-
-	fluxInfraDiff, err := k8s.flux(
-		fmt.Sprintf(
-			`diff kustomization infra-custom \
-			--path %s/infra`,
-			hostDir,
-		),
-	)
-
-	if err != nil {
-		log.Println("infra-custom error, failed for error: ", err)
-		log.Println(k8s.container.ExitCode(k8s.ctx))
+	cfg.DiffSelector = os.Getenv("DIFF_SELECTOR")
+	cfg.FluxResourceProfile = k3sflux.FluxResourceProfile(os.Getenv("FLUX_RESOURCE_PROFILE"))
+	cfg.FailOnWarnings = os.Getenv("FAIL_ON_WARNINGS") == "true"
+	cfg.FailOnDiff = os.Getenv("FAIL_ON_DIFF") == "true"
+	cfg.GreenfieldDiff = os.Getenv("GREENFIELD_DIFF") == "true"
+	cfg.TolerateMissingCRDs = os.Getenv("TOLERATE_MISSING_CRDS") == "true"
+	cfg.Platform = os.Getenv("PLATFORM")
+	cfg.K3sVersion = os.Getenv("K3S_VERSION")
+	if image := os.Getenv("K3S_IMAGE"); image != "" {
+		cfg.K3sVersion = image
 	}
-	log.Println(fluxInfraDiff)
-
-	fluxAppsDiff, err := k8s.flux(
-		fmt.Sprintf(
-			`diff kustomization apps \
-			--path %s/apps`,
-			hostDir,
-		),
-	)
-
-	if err != nil {
-		log.Println("apps error, failed for error: ", err)
-		log.Println(k8s.container.ExitCode(k8s.ctx))
+	cfg.CleanupGitCommits = os.Getenv("CLEANUP_GIT_COMMITS") == "true"
+	if authors := os.Getenv("CLEANUP_GIT_AUTHORS"); authors != "" {
+		cfg.CleanupGitAuthors = strings.Split(authors, ",")
+	}
+	if os.Getenv("SHOW_SECRETS") == "true" {
+		cfg.MaskSecrets = false
+	}
+	if timeout := os.Getenv("BOOTSTRAP_TIMEOUT"); timeout != "" {
+		if cfg.BootstrapTimeout, err = time.ParseDuration(timeout); err != nil {
+			return cfg, fmt.Errorf("invalid BOOTSTRAP_TIMEOUT: %v", err)
+		}
+	}
+	if retries := os.Getenv("BOOTSTRAP_RETRIES"); retries != "" {
+		if cfg.BootstrapRetries, err = strconv.Atoi(retries); err != nil {
+			return cfg, fmt.Errorf("invalid BOOTSTRAP_RETRIES: %v", err)
+		}
+	}
+	if backoff := os.Getenv("BOOTSTRAP_RETRY_BACKOFF"); backoff != "" {
+		if cfg.BootstrapRetryBackoff, err = time.ParseDuration(backoff); err != nil {
+			return cfg, fmt.Errorf("invalid BOOTSTRAP_RETRY_BACKOFF: %v", err)
+		}
+	}
+	if timeout := os.Getenv("BOOTSTRAP_RETRY_TIMEOUT"); timeout != "" {
+		if cfg.BootstrapRetryTimeout, err = time.ParseDuration(timeout); err != nil {
+			return cfg, fmt.Errorf("invalid BOOTSTRAP_RETRY_TIMEOUT: %v", err)
+		}
+	}
+	if timeout := os.Getenv("SYSTEM_PODS_TIMEOUT"); timeout != "" {
+		if cfg.SystemPodsTimeout, err = time.ParseDuration(timeout); err != nil {
+			return cfg, fmt.Errorf("invalid SYSTEM_PODS_TIMEOUT: %v", err)
+		}
+	}
+	if images := os.Getenv("PREPULL_IMAGES"); images != "" {
+		cfg.PrePullImages = strings.Split(images, ",")
+	}
+	if extra := os.Getenv("FLUX_COMPONENTS_EXTRA"); extra != "" {
+		cfg.ComponentsExtra = strings.Split(extra, ",")
+	}
+	if ignore := os.Getenv("DIFF_IGNORE_ANNOTATIONS"); ignore != "" {
+		cfg.DiffIgnoreAnnotations = map[string]string{}
+		for _, pair := range strings.Split(ignore, ",") {
+			key, value, _ := strings.Cut(pair, "=")
+			cfg.DiffIgnoreAnnotations[key] = value
+		}
+	}
+	if checks := os.Getenv("POLICY_CHECKS"); checks != "" {
+		for _, check := range strings.Split(checks, ",") {
+			manifests, policies, ok := strings.Cut(check, "=")
+			if !ok {
+				return cfg, fmt.Errorf("invalid POLICY_CHECKS entry %q, expected manifests=policies", check)
+			}
+			cfg.PolicyChecks = append(cfg.PolicyChecks, k3sflux.PolicyCheck{ManifestsPath: manifests, PoliciesPath: policies})
+		}
+	}
+	cfg.K3s = k3sflux.K3sOptions{
+		EnableTraefik:       os.Getenv("K3S_ENABLE_TRAEFIK") == "true",
+		EnableMetricsServer: os.Getenv("K3S_ENABLE_METRICS_SERVER") == "true",
+		DisableServiceLB:    os.Getenv("K3S_DISABLE_SERVICELB") == "true",
+	}
+	if extra := os.Getenv("K3S_EXTRA_ARGS"); extra != "" {
+		cfg.ExtraK3sServerArgs = strings.Fields(extra)
+	}
+	if gates := os.Getenv("FEATURE_GATES"); gates != "" {
+		cfg.FeatureGates = map[string]bool{}
+		for _, gate := range strings.Split(gates, ",") {
+			name, value, _ := strings.Cut(gate, "=")
+			if cfg.FeatureGates[name], err = strconv.ParseBool(value); err != nil {
+				return cfg, fmt.Errorf("invalid FEATURE_GATES entry %q: %v", gate, err)
+			}
+		}
+	}
+	if retries := os.Getenv("WAIT_RETRIES"); retries != "" {
+		if cfg.WaitRetries, err = strconv.Atoi(retries); err != nil {
+			return cfg, fmt.Errorf("invalid WAIT_RETRIES: %v", err)
+		}
+	}
+	if backoff := os.Getenv("WAIT_BACKOFF"); backoff != "" {
+		if cfg.WaitBackoff, err = time.ParseDuration(backoff); err != nil {
+			return cfg, fmt.Errorf("invalid WAIT_BACKOFF: %v", err)
+		}
+	}
+	if agents := os.Getenv("K3S_AGENTS"); agents != "" {
+		if cfg.Agents, err = strconv.Atoi(agents); err != nil {
+			return cfg, fmt.Errorf("invalid K3S_AGENTS: %v", err)
+		}
+	}
+	if timeout := os.Getenv("AGENT_JOIN_TIMEOUT"); timeout != "" {
+		if cfg.AgentJoinTimeout, err = time.ParseDuration(timeout); err != nil {
+			return cfg, fmt.Errorf("invalid AGENT_JOIN_TIMEOUT: %v", err)
+		}
 	}
-	log.Println(fluxAppsDiff)
+	switch policy := os.Getenv("AGENT_JOIN_FAILURE"); policy {
+	case "", "fail":
+		cfg.OnAgentJoinFailure = k3sflux.AgentJoinFail
+	case "proceed":
+		cfg.OnAgentJoinFailure = k3sflux.AgentJoinProceed
+	default:
+		return cfg, fmt.Errorf("invalid AGENT_JOIN_FAILURE %q, expected fail or proceed", policy)
+	}
+	cfg.PersistData = os.Getenv("PERSIST_DATA") == "true"
+	switch policy := os.Getenv("EXISTING_CLUSTER"); policy {
+	case "", "reuse":
+		cfg.OnExistingCluster = k3sflux.ExistingClusterReuse
+	case "reset":
+		cfg.OnExistingCluster = k3sflux.ExistingClusterReset
+	case "error":
+		cfg.OnExistingCluster = k3sflux.ExistingClusterError
+	default:
+		return cfg, fmt.Errorf("invalid EXISTING_CLUSTER %q, expected reuse, reset or error", policy)
+	}
+	switch auth := os.Getenv("BOOTSTRAP_AUTH"); auth {
+	case "", "token":
+	case "ssh":
+		cfg.BootstrapAuth = k3sflux.BootstrapAuthSSH
+		cfg.SSHPrivateKeyFile = os.Getenv("SSH_PRIVATE_KEY_FILE")
+		cfg.SSHKnownHostsFile = os.Getenv("SSH_KNOWN_HOSTS_FILE")
+	default:
+		return cfg, fmt.Errorf("invalid BOOTSTRAP_AUTH %q, expected token or ssh", auth)
+	}
+	if os.Getenv("GIT_REF_FALLBACK") == "true" {
+		cfg.OnMissingRef = k3sflux.MissingRefFallbackDefault
+	}
+	if mirror := os.Getenv("DOCKER_HUB_MIRROR"); mirror != "" {
+		cfg.RegistryMirrors = map[string]string{"docker.io": mirror}
+		ca := os.Getenv("DOCKER_HUB_MIRROR_CA_FILE")
+		insecure := os.Getenv("DOCKER_HUB_MIRROR_INSECURE") == "true"
+		if ca != "" || insecure {
+			u, err := url.Parse(mirror)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid DOCKER_HUB_MIRROR: %v", err)
+			}
+			cfg.RegistryTLS = map[string]k3sflux.RegistryTLS{u.Host: {CAFile: ca, InsecureSkipVerify: insecure}}
+		}
+	}
+	return cfg, nil
+}
 
-	fluxSystemDiff, err := k8s.flux(fmt.Sprintf(
-		`diff kustomization flux-system \
-			--path %s/clusters/tests`,
-		hostDir,
-	))
-	if err != nil {
-		log.Println("flux-system error, failed for error: ", err)
-		log.Println(k8s.container.ExitCode(k8s.ctx))
-		// panic(err)
+// printResult writes the run result for humans.
+func printResult(r *k3sflux.RunResult) {
+	for _, p := range r.Phases {
+		if p.Output != "" && !strings.HasPrefix(p.Name, "diff ") {
+			fmt.Println(p.Output)
+		}
+		if p.Error != "" {
+			log.Printf("%s error, failed for error: %v", p.Name, p.Error)
+		}
+	}
+	for _, ks := range r.Kustomizations {
+		status := "ready"
+		if !ks.Ready {
+			status = fmt.Sprintf("not ready (%s: %s)", ks.Reason, ks.Message)
+		}
+		fmt.Printf("kustomization %s/%s %s\n", ks.Namespace, ks.Name, status)
+	}
+	for _, d := range r.Diffs {
+		log.Print(d.Report())
+	}
+	for _, p := range r.Policies {
+		for _, v := range p.Violations {
+			log.Printf("policy violation in %s: %s: %s", p.ManifestsPath, v.Namespace, v.Message)
+		}
+		for _, w := range p.Warnings {
+			log.Printf("policy warning in %s: %s: %s", p.ManifestsPath, w.Namespace, w.Message)
+		}
+	}
+	if drifted := r.Drifted(); len(drifted) > 0 {
+		log.Printf("drift detected in %d of %d kustomization(s): %s", len(drifted), len(r.Diffs), strings.Join(drifted, ", "))
+	}
+	log.Print(k3sflux.SummaryLine(*r))
+	if len(r.Warnings) > 0 {
+		log.Printf("%d warning(s):", len(r.Warnings))
+		for _, w := range r.Warnings {
+			log.Printf("  - %s", w)
+		}
+	}
+	if r.Failed() {
+		log.Printf("run failed after %v: %s", r.Finished.Sub(r.Started).Round(time.Second), r.Error)
 	}
-	log.Println(fluxSystemDiff)
 }